@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for count and aggregation
+ */
+
+package gonm
+
+import (
+	"math"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Count returns the number of entities that match q.
+//
+// The datastore client which Gonm uses has no aggregation query,
+// so Count runs q as keys-only query and counts the keys without keeping them.
+// If Transaction gonm use this method, q must be an ancestor query.
+func (gm *Gonm) Count(q *Query) (int, error) {
+	bq, err := q.backendQuery()
+	if err != nil {
+		return 0, gm.stackError("Count", nil, err)
+	}
+	it, err := gm.run("Count", bq.KeysOnly(), false)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		_, err := it.Next(nil)
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Sum returns the sum of the numeric values of property of the entities that match q.
+//
+// Sum runs q as projection query of property, so the property must be indexed,
+// and q must not have an equality filter on property, which Datastore rejects in projection queries.
+// *QueryError is returned for such q.
+// If the struct of q does not have property, *PropertyError is returned.
+// Non-numeric values are ignored, and every value of multi-valued property is added.
+// If Transaction gonm use this method, q must be an ancestor query.
+func (gm *Gonm) Sum(q *Query, property string) (float64, error) {
+	sum, _, err := gm.aggregate("Sum", q, property)
+	return sum, err
+}
+
+// Avg returns the average of the numeric values of property of the entities that match q.
+// If there is no numeric value, Avg returns NaN.
+//
+// Avg runs q in the same way as Sum.
+func (gm *Gonm) Avg(q *Query, property string) (float64, error) {
+	sum, n, err := gm.aggregate("Avg", q, property)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return math.NaN(), nil
+	}
+	return sum / float64(n), nil
+}
+
+// aggregate returns the sum and the number of the numeric values of property.
+func (gm *Gonm) aggregate(op string, q *Query, property string) (sum float64, n int, err error) {
+	bq, err := q.Project(property).backendQuery()
+	if err != nil {
+		return 0, 0, gm.stackError(op, nil, err)
+	}
+	for _, f := range bq.Description.Filters {
+		if f.Op == "=" && f.Property == bq.Description.Projection[0] {
+			return 0, 0, gm.stackError(op, nil, &QueryError{Op: op, Reason: "property " + f.Property + " has an equality filter"})
+		}
+	}
+	it, err := gm.run(op, bq, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	for {
+		var props datastore.PropertyList
+		_, err := it.Next(&props)
+		if err == iterator.Done {
+			return sum, n, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, prop := range props {
+			if prop.Name != property {
+				continue
+			}
+			values, ok := prop.Value.([]interface{})
+			if !ok {
+				values = []interface{}{prop.Value}
+			}
+			for _, v := range values {
+				switch v := v.(type) {
+				case int64:
+					sum += float64(v)
+					n++
+				case float64:
+					sum += v
+					n++
+				}
+			}
+		}
+	}
+}
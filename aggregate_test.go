@@ -0,0 +1,68 @@
+package gonm
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testScoreModel struct {
+	ID    int64 `datastore:"-"`
+	Group string
+	Score int64
+}
+
+func TestGonm_Aggregate(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := []*testScoreModel{
+		{ID: 1, Group: "a", Score: 10},
+		{ID: 2, Group: "a", Score: 20},
+		{ID: 3, Group: "b", Score: 60},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	q := gm.Query(&testScoreModel{}).Filter("Group =", "a")
+
+	count, err := gm.Count(q)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(2, count)
+
+	sum, err := gm.Sum(q, "Score")
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(float64(30), sum)
+
+	avg, err := gm.Avg(q, "Score")
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(float64(15), avg)
+
+	avg, err = gm.Avg(gm.Query(&testScoreModel{}).Filter("Group =", "none"), "Score")
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.True(math.IsNaN(avg), "average of no value")
+
+	_, err = gm.Sum(q.Filter("Score =", 10), "Score")
+	var qerr *QueryError
+	if assert.True(errors.As(err, &qerr), "equality filter on the projected property") {
+		assert.Equal("Sum", qerr.Op)
+	}
+	sum, err = gm.Sum(q.Filter("Score >", 10), "Score")
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(float64(20), sum, "inequality filter on the projected property")
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for storage backend
+ */
+
+package gonm
+
+import (
+	"context"
+
+	"github.com/komem3/gonm/internal/backend"
+)
+
+func init() {
+	backend.NewGonm = func(ctx context.Context, b backend.Backend) interface{} {
+		return fromBackend(ctx, b)
+	}
+}
+
+// fromBackend generate Gonm running on b.
+// Package gonmtest and gonmfile generate Gonm by fromBackend through backend.NewGonm.
+//
+// Gonm generates keys from structures and manages cache, and b stores the entities.
+func fromBackend(ctx context.Context, b backend.Backend) *Gonm {
+	gm := &Gonm{
+		Context: ctx,
+		Errors:  NewErrorJournal(DefaultJournalSize),
+		backend: b,
+		cache:   newCache(),
+	}
+	if db, ok := b.(*datastoreBackend); ok {
+		gm.Client = db.client
+	}
+	return gm
+}
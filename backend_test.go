@@ -0,0 +1,64 @@
+package gonm
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingBackend struct {
+	backend.Backend
+	gets int32
+}
+
+func (b *countingBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	atomic.AddInt32(&b.gets, 1)
+	return b.Backend.GetMulti(ctx, keys, dst)
+}
+
+func TestFromBackend(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	counting := &countingBackend{Backend: newTestGonm(ctx).backend}
+	gm := fromBackend(ctx, counting)
+	assert.Nil(gm.Client, "decorated backend is not Datastore")
+
+	putModel := &testModel{ID: 1, Name: "Michael"}
+	if _, err := gm.Put(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	gm.CacheClear()
+
+	for i := 0; i < 2; i++ {
+		getModel := &testModel{ID: 1}
+		if err := gm.Get(getModel); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal(putModel, getModel)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&counting.gets), "second get use cache")
+
+	it, err := gm.Run(datastore.NewQuery("testModel").Filter("__key__ =", datastore.IDKey("testModel", 1, nil)))
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	runModel := &testModel{}
+	if _, err := it.Next(runModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel, runModel, "run on decorated backend")
+
+	_, err = gm.RunInTransaction(func(gm *Gonm) error {
+		assert.Nil(gm.Transaction, "decorated transaction is not datastore.Transaction")
+		return gm.Get(&testModel{ID: 1})
+	})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&counting.gets), "transaction does not use backend.GetMulti")
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for bulk operations by query
+ */
+
+package gonm
+
+import (
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+)
+
+// BulkOptions configures DeleteByQuery and UpdateByQuery.
+type BulkOptions struct {
+	// DryRun runs the query without deleting or putting entities.
+	// UpdateByQuery calls the function with the entities in dry run, but does not put them.
+	DryRun bool
+	// Progress is called after every batch.
+	Progress func(p BulkProgress)
+	// Cursor is the cursor returned by the previous run that failed. The run resumes from it.
+	Cursor datastore.Cursor
+}
+
+// BulkProgress is the progress of DeleteByQuery and UpdateByQuery.
+type BulkProgress struct {
+	// Keys are the keys of the entities processed in the batch.
+	Keys []*datastore.Key
+	// Processed is the number of entities processed since the run started.
+	Processed int
+	// Cursor is the position after the batch.
+	Cursor datastore.Cursor
+}
+
+// DeleteByQuery deletes all entities that match q in batches of datastorePutMultiMaxItems.
+//
+// The limit of q caps the number of the entities read in a run, and the offset of q skips entities only once.
+// Processed is the number of the deleted entities. Cursor is the position after the last deleted batch,
+// and is passed to BulkOptions.Cursor to resume after an error.
+// Batches are not deleted atomically, so this method is not available in transaction.
+func (gm *Gonm) DeleteByQuery(q *Query, opts *BulkOptions) (processed int, cursor datastore.Cursor, err error) {
+	return gm.bulk("DeleteByQuery", q, opts, func(keys []*datastore.Key, dryRun bool) ([]*datastore.Key, error) {
+		if dryRun {
+			return keys, nil
+		}
+		if err := gm.deleteMultiByKeys("DeleteByQuery", keys); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	})
+}
+
+// UpdateByQuery calls f with every entity that matches q and puts the entities in batches of datastorePutMultiMaxItems.
+//
+// newDst returns a new destination of an entity, which is a pointer to a struct and complemented with its key.
+// If f returns an error, the batch is not put and UpdateByQuery returns the error.
+// Entities deleted after the query are skipped.
+// Processed and cursor are the same as DeleteByQuery. This method is not available in transaction.
+func (gm *Gonm) UpdateByQuery(q *Query, newDst func() interface{}, f func(dst interface{}) error, opts *BulkOptions) (processed int, cursor datastore.Cursor, err error) {
+	return gm.bulk("UpdateByQuery", q, opts, func(keys []*datastore.Key, dryRun bool) ([]*datastore.Key, error) {
+		dst := make([]interface{}, len(keys))
+		for i := range dst {
+			dst[i] = newDst()
+			if v := reflect.ValueOf(dst[i]); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+				return nil, gm.stackError("UpdateByQuery", nil, invalidType(dst[i], "pointer to a struct"))
+			}
+		}
+		// entities are read without cache not to update stale entities
+		var merr datastore.MultiError
+		if err := gm.getMultiByKeysConsistency(keys, dst); err != nil {
+			var ok bool
+			if merr, ok = err.(datastore.MultiError); !ok {
+				return nil, err
+			}
+			for _, e := range merr {
+				if e != nil && e != datastore.ErrNoSuchEntity {
+					return nil, merr
+				}
+			}
+		}
+
+		var updatedKeys []*datastore.Key
+		var updated []interface{}
+		for i, key := range keys {
+			if merr != nil && merr[i] != nil {
+				continue
+			}
+			if err := setStructKey(dst[i], key); err != nil {
+				return nil, gm.stackError("UpdateByQuery", []*datastore.Key{key}, err)
+			}
+			if err := f(dst[i]); err != nil {
+				return nil, err
+			}
+			updatedKeys = append(updatedKeys, key)
+			updated = append(updated, dst[i])
+		}
+		if dryRun || len(updated) == 0 {
+			return updatedKeys, nil
+		}
+		if _, err := gm.PutMulti(updated); err != nil {
+			return nil, err
+		}
+		return updatedKeys, nil
+	})
+}
+
+// bulk runs q as keys-only query in batches and calls process with the keys of every batch.
+// process returns the keys of the processed entities.
+func (gm *Gonm) bulk(op string, q *Query, opts *BulkOptions, process func(keys []*datastore.Key, dryRun bool) ([]*datastore.Key, error)) (processed int, cursor datastore.Cursor, err error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	cursor = opts.Cursor
+	if gm.tx != nil {
+		return 0, cursor, gm.stackError(op, nil, ErrInTransaction)
+	}
+	if gm.readOnly {
+		return 0, cursor, gm.stackError(op, nil, ErrReadOnly)
+	}
+
+	if err := q.Err(); err != nil {
+		return 0, cursor, gm.stackError(op, nil, err)
+	}
+	limit := int(q.query.Description.Limit)
+
+	read := 0
+	for {
+		size := datastorePutMultiMaxItems
+		if limit >= 0 && limit-read < size {
+			size = limit - read
+		}
+		if size == 0 {
+			return processed, cursor, nil
+		}
+		bq := q.Limit(size)
+		if cursor.String() != "" {
+			// the cursor is after the offset
+			bq = bq.Start(cursor).Offset(0)
+		}
+		rq, err := bq.backendQuery()
+		if err != nil {
+			return processed, cursor, gm.stackError(op, nil, err)
+		}
+		keys, next, err := gm.getKeysOnly(op, rq)
+		if err != nil {
+			return processed, cursor, err
+		}
+		if len(keys) == 0 {
+			return processed, cursor, nil
+		}
+		read += len(keys)
+
+		done, err := process(keys, opts.DryRun)
+		if err != nil {
+			return processed, cursor, err
+		}
+		processed += len(done)
+		cursor = next
+		if opts.Progress != nil {
+			opts.Progress(BulkProgress{Keys: done, Processed: processed, Cursor: cursor})
+		}
+		if len(keys) < size {
+			return processed, cursor, nil
+		}
+	}
+}
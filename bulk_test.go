@@ -0,0 +1,134 @@
+package gonm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGonm_DeleteByQuery(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	defer func(n int) { datastorePutMultiMaxItems = n }(datastorePutMultiMaxItems)
+	datastorePutMultiMaxItems = 2
+
+	parent := datastore.NameKey("testGroup", "delete", nil)
+	putModel := []*testModel2{
+		{IDOther: 1, Name: "Michael", Parent: parent},
+		{IDOther: 2, Name: "Tom", Parent: parent},
+		{IDOther: 3, Name: "Jack", Parent: parent},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	q := gm.Query(&testModel2{}).AncestorKey(parent)
+
+	processed, _, err := gm.DeleteByQuery(q, &BulkOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(3, processed, "dry run")
+	found, err := gm.GetMultiPartial(putModel)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]bool{true, true, true}, found, "dry run does not delete")
+
+	var progress []int
+	processed, _, err = gm.DeleteByQuery(q, &BulkOptions{Progress: func(p BulkProgress) {
+		progress = append(progress, p.Processed)
+	}})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(3, processed)
+	assert.Equal([]int{2, 3}, progress, "progress of every batch")
+	found, err = gm.GetMultiPartial(putModel)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]bool{false, false, false}, found)
+
+	limited := []*testModel2{
+		{IDOther: 1, Name: "Michael", Parent: parent},
+		{IDOther: 2, Name: "Tom", Parent: parent},
+		{IDOther: 3, Name: "Jack", Parent: parent},
+		{IDOther: 4, Name: "Hanako", Parent: parent},
+	}
+	if _, err := gm.PutMulti(limited); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	if err := gm.GetMulti([]*testModel2{{IDOther: 2, Parent: parent}, {IDOther: 3, Parent: parent}}); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	processed, _, err = gm.DeleteByQuery(q.Order("__key__").Offset(1).Limit(2), nil)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(2, processed, "limit caps the total")
+	found, err = gm.GetMultiPartial(limited)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]bool{true, false, false, true}, found, "cached entities are also deleted")
+
+	_, _, err = gm.ReadAt(time.Now()).DeleteByQuery(q, nil)
+	assert.Equal(ErrReadOnly, err)
+}
+
+func TestGonm_UpdateByQuery(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	defer func(n int) { datastorePutMultiMaxItems = n }(datastorePutMultiMaxItems)
+	datastorePutMultiMaxItems = 2
+
+	parent := datastore.NameKey("testGroup", "update", nil)
+	putModel := []*testModel2{
+		{IDOther: 1, Name: "Michael", Parent: parent},
+		{IDOther: 2, Name: "Tom", Parent: parent},
+		{IDOther: 3, Name: "Jack", Parent: parent},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	q := gm.Query(&testModel2{}).AncestorKey(parent)
+	newDst := func() interface{} { return &testModel2{} }
+
+	errStop := errors.New("stop")
+	processed, cursor, err := gm.UpdateByQuery(q, newDst, func(dst interface{}) error {
+		model := dst.(*testModel2)
+		if model.IDOther == 3 {
+			return errStop
+		}
+		model.Name += "!"
+		return nil
+	}, nil)
+	assert.Equal(errStop, err)
+	assert.Equal(2, processed, "first batch is updated")
+
+	processed, _, err = gm.UpdateByQuery(q, newDst, func(dst interface{}) error {
+		dst.(*testModel2).Name += "!"
+		return nil
+	}, &BulkOptions{Cursor: cursor})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(1, processed, "resume from cursor")
+
+	getModel := []*testModel2{{IDOther: 1, Parent: parent}, {IDOther: 3, Parent: parent}}
+	if err := gm.GetMultiConsistency(getModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal("Michael!", getModel[0].Name)
+	assert.Equal("Jack!", getModel[1].Name)
+}
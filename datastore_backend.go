@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for Google Cloud Datastore backend
+ */
+
+package gonm
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+)
+
+// datastoreBackend is backend.Backend of Google Cloud Datastore.
+type datastoreBackend struct {
+	client *datastore.Client
+}
+
+func (b *datastoreBackend) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return b.client.AllocateIDs(ctx, keys)
+}
+
+func (b *datastoreBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return b.client.GetMulti(ctx, keys, dst)
+}
+
+// GetMultiAt reads in a read-only transaction at readTime, so that every call reads the same snapshot.
+func (b *datastoreBackend) GetMultiAt(ctx context.Context, readTime time.Time, keys []*datastore.Key, dst interface{}) error {
+	tx, err := b.client.NewTransaction(ctx, datastore.ReadOnly, datastore.WithReadTime(readTime))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	return tx.GetMulti(keys, dst)
+}
+
+func (b *datastoreBackend) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return b.client.PutMulti(ctx, keys, src)
+}
+
+func (b *datastoreBackend) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return b.client.DeleteMulti(ctx, keys)
+}
+
+func (b *datastoreBackend) Mutate(ctx context.Context, muts ...*backend.Mutation) ([]*datastore.Key, error) {
+	return b.client.Mutate(ctx, datastoreMutations(muts)...)
+}
+
+func (b *datastoreBackend) Run(ctx context.Context, q *backend.Query) backend.Iterator {
+	return b.client.Run(ctx, q.Datastore)
+}
+
+func (b *datastoreBackend) GetAll(ctx context.Context, q *backend.Query, dst interface{}) ([]*datastore.Key, error) {
+	return b.client.GetAll(ctx, q.Datastore, dst)
+}
+
+func (b *datastoreBackend) NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (backend.Transaction, error) {
+	tx, err := b.client.NewTransaction(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreTransaction{client: b.client, ctx: ctx, tx: tx}, nil
+}
+
+func (b *datastoreBackend) RunInTransaction(ctx context.Context, f func(tx backend.Transaction) error, opts ...datastore.TransactionOption) (backend.Commit, error) {
+	cmt, err := b.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&datastoreTransaction{client: b.client, ctx: ctx, tx: tx})
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreCommit{commit: cmt}, nil
+}
+
+func (b *datastoreBackend) Close() error {
+	return b.client.Close()
+}
+
+type datastoreTransaction struct {
+	// client and ctx are used to run queries in the transaction.
+	client *datastore.Client
+	ctx    context.Context
+	tx     *datastore.Transaction
+}
+
+func (t *datastoreTransaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return t.tx.GetMulti(keys, dst)
+}
+
+func (t *datastoreTransaction) PutMulti(keys []*datastore.Key, src interface{}) ([]backend.PendingKey, error) {
+	pkeys, err := t.tx.PutMulti(keys, src)
+	if err != nil {
+		return nil, err
+	}
+	return pendingKeys(pkeys), nil
+}
+
+func (t *datastoreTransaction) DeleteMulti(keys []*datastore.Key) error {
+	return t.tx.DeleteMulti(keys)
+}
+
+func (t *datastoreTransaction) Mutate(muts ...*backend.Mutation) ([]backend.PendingKey, error) {
+	pkeys, err := t.tx.Mutate(datastoreMutations(muts)...)
+	if err != nil {
+		return nil, err
+	}
+	return pendingKeys(pkeys), nil
+}
+
+func (t *datastoreTransaction) Run(q *backend.Query) backend.Iterator {
+	return t.client.Run(t.ctx, q.Datastore.Transaction(t.tx))
+}
+
+func (t *datastoreTransaction) GetAll(q *backend.Query, dst interface{}) ([]*datastore.Key, error) {
+	return t.client.GetAll(t.ctx, q.Datastore.Transaction(t.tx), dst)
+}
+
+func (t *datastoreTransaction) Commit() (backend.Commit, error) {
+	cmt, err := t.tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreCommit{commit: cmt}, nil
+}
+
+func (t *datastoreTransaction) Rollback() error {
+	return t.tx.Rollback()
+}
+
+type datastoreCommit struct {
+	commit *datastore.Commit
+}
+
+func (c *datastoreCommit) Key(p backend.PendingKey) *datastore.Key {
+	return c.commit.Key(p.(*datastore.PendingKey))
+}
+
+// datastoreCommitOf returns *datastore.Commit of c.
+// If c is not the Commit of Google Cloud Datastore, datastoreCommitOf returns nil.
+func datastoreCommitOf(c backend.Commit) *datastore.Commit {
+	if dc, ok := c.(*datastoreCommit); ok {
+		return dc.commit
+	}
+	return nil
+}
+
+func pendingKeys(pkeys []*datastore.PendingKey) []backend.PendingKey {
+	ret := make([]backend.PendingKey, len(pkeys))
+	for i, pkey := range pkeys {
+		ret[i] = pkey
+	}
+	return ret
+}
+
+func datastoreMutations(muts []*backend.Mutation) []*datastore.Mutation {
+	ret := make([]*datastore.Mutation, len(muts))
+	for i, mut := range muts {
+		ret[i] = mut.Datastore
+	}
+	return ret
+}
@@ -82,10 +82,37 @@ Gonm support Run and GetAll, but I reconmmend using GetKeysOnly.
 	   // TODO: Handle error.
 	}
 
+Gonm.Count, Gonm.Sum and Gonm.Avg aggregate the entities that match a query.
+
+The other query methods take Query of gonm, which is described in Query Builder.
+
+	n, err := gm.Count(gm.Query(&User{}).Filter("Age >=", 20))
+
+Gonm.GetProjection loads a projection query into a struct which may have only the projected fields.
+The partial entities are never stored in the cache.
+
+	var names []struct{ Name string }
+	keys, err := gm.GetProjection(gm.Query(&User{}).Project("Name"), &names)
+
+
+Pagination
+
+Gonm.Paginate returns a page of query results with the tokens of the next and previous pages.
+The tokens are signed with Gonm.PageTokenKey.
+
+	gm.PageTokenKey = []byte("secret")
+	var users []*User
+	page, err := gm.Paginate(gm.Query(&User{}).Order("Name"), 20, token, &users)
+	if err != nil {
+	   // TODO: Handle error.
+	}
+	nextToken := page.NextToken
+
 
 Transactions
 
 Gonm.RunInTransaction runs a function in a transaction.
+In a transaction, queries must be ancestor queries.
 
 	Users := []*User{{ID: 1}, {ID: 2}}
 	_, err = gm.RunInTransaction(func(gm *Gonm) error {
@@ -100,6 +127,91 @@ Gonm.RunInTransaction runs a function in a transaction.
 		return nil
 	})
 
+Gonm.RetryPolicy sets the attempts, the backoff and the retryable errors of RunInTransaction.
+
+	gm.RetryPolicy = &gonm.RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond, Jitter: 0.5}
+
+Side effects which must follow the commit are registered by OnCommit and OnRollback in the transaction.
+They are never called for retried attempts.
+
+	gm.OnCommit(func(*datastore.Commit) { sendMail(user) })
+
+Gonm.RunInReadOnlyTransaction reads a consistent snapshot of entities.
+Its reads bypass the cache, and its writes return ErrReadOnly.
+
+	err = gm.RunInReadOnlyTransaction(func(gm *Gonm) error {
+		return gm.GetMulti(Users)
+	})
+
+Gonm.ReadAt reads entities by keys as they were at a time on Google Cloud Datastore.
+Snapshot reads skip the cache, and the other backends return ErrUnsupported.
+
+	err = gm.ReadAt(time.Now().Add(-time.Hour)).GetMulti(Users)
+
+An int64 field tagged with gonm:"version" protects entities from lost updates.
+Put, PutMulti, NewUpdate, NewUpsert and NewInsert check the version against the stored entity in a transaction,
+return *VersionConflictError if they differ, and increment the version when the transaction is committed.
+The version of an entity which does not exist is 0. Out of transaction, they run in a new transaction.
+The version field may be in an embedded struct, and is named in the same way as datastore.SaveStruct.
+
+	type Document struct {
+		ID      int64 `datastore:"-"`
+		Body    string
+		Version int64 `gonm:"version"`
+	}
+
+RunInTransaction in a transaction returns ErrNestedTransaction. If Gonm.JoinTransaction is true,
+it runs in the outer transaction instead, so a function which needs atomicity can be called in both ways.
+
+
+Query Builder
+
+Gonm.Query builds a query for the kind of a struct.
+The ancestor is given as a struct, and property names are checked against the struct fields.
+
+	var users []*User
+	keys, err := gm.Query(&User{}).Ancestor(group).Filter("Name =", "Tom").GetAll(&users)
+	if err != nil {
+	   // TODO: Handle error.
+	}
+
+Query records its content as well as building datastore.Query, so it runs on every backend of Gonm.
+
+With Go 1.18 or later, NewQuery builds the query from a type.
+
+	users, keys, err := gonm.NewQuery[User]().Order("-Age").Limit(10).GetAll(gm)
+
+
+Generic Repository
+
+With Go 1.18 or later, Repo provides type-safe access to a kind.
+
+	users := gonm.NewRepo[User, int64](gm)
+	user, err := users.Get(ctx, 1)
+	if err != nil {
+	   // TODO: Handle error.
+	}
+
+
+Testing Without Datastore
+
+Package gonmtest provides the backend which stores entities on memory.
+It is useful for hermetic tests of code using Gonm.
+
+	gm := gonmtest.NewMemory().Gonm(ctx)
+
+The backends run queries built by Gonm.Query and datastore.NewQuery, and return ErrUnsupported
+for OR, IN, != and distinct queries. They also read the number of attempts only from gonm.MaxAttempts.
+
+Package gonmfile provides the backend which persists entities to a single file,
+for local tools and demos without a cloud project or the emulator.
+
+	backend, err := gonmfile.Open("gonm.db")
+	if err != nil {
+	   // TODO: Handle error.
+	}
+	gm := backend.Gonm(ctx)
+
 
 Google Cloud Datastore Emulator
 
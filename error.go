@@ -8,7 +8,12 @@ package gonm
 
 import (
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
 	"github.com/pkg/errors"
 )
 
@@ -17,16 +22,296 @@ var (
 	ErrInTransaction = errors.New("gonm: transaction gonm is not available this method")
 	// ErrNoIDField is returned when struct do not have ID field in tag
 	ErrNoIDField = errors.New("gonm: At least one ID or id tag")
+	// ErrInvalidDestination is returned when dst or src of method is not expected type.
+	// The returned error is *InvalidTypeError.
+	ErrInvalidDestination = errors.New("gonm: invalid destination")
+	// ErrDuplicateKeyField is returned when struct has more than one id, kind or parent field.
+	// The returned error is *FieldError.
+	ErrDuplicateKeyField = errors.New("gonm: Only one field may be marked")
+	// ErrUnsupportedIDType is returned when ID field is neither int64 nor string.
+	// The returned error is *FieldError.
+	ErrUnsupportedIDType = errors.New("gonm: ID field must be int64 or string")
+	// ErrIncompleteKey is returned when getting or deleting entity by struct that has no ID.
+	// The returned error is *KeyError.
+	ErrIncompleteKey = errors.New("gonm: cannot find a key for struct")
+	// ErrUnsupportedVersionType is returned when version field is not int64.
+	// The returned error is *FieldError.
+	ErrUnsupportedVersionType = errors.New("gonm: version field must be int64")
+	// ErrVersionConflict is returned when the version field of a struct differs from the stored entity.
+	// The returned error is *VersionConflictError.
+	ErrVersionConflict = errors.New("gonm: version conflict")
+	// ErrNotAllocated is returned when datastore did not allocate ID.
+	ErrNotAllocated = errors.New("gonm: not allocate id")
+	// ErrUnknownProperty is returned when a query uses a property that the struct does not have.
+	// The returned error is *PropertyError.
+	ErrUnknownProperty = errors.New("gonm: unknown property")
+	// ErrNestedTransaction is returned when RunInTransaction is called in transaction without JoinTransaction.
+	ErrNestedTransaction = errors.New("gonm: RunInTransaction is called in transaction")
+	// ErrJoinTransactionOptions is returned when transaction options are passed to RunInTransaction
+	// which joins the outer transaction.
+	ErrJoinTransactionOptions = errors.New("gonm: transaction options are passed to joined transaction")
+	// ErrNoAncestor is returned when a query in transaction is not an ancestor query.
+	ErrNoAncestor = backend.ErrNoAncestor
+	// ErrNoProjection is returned when GetProjection runs a query which is not a projection query.
+	ErrNoProjection = errors.New("gonm: query is not a projection query")
+	// ErrNoPageTokenKey is returned when Paginate is used without PageTokenKey.
+	ErrNoPageTokenKey = errors.New("gonm: PageTokenKey is not set")
+	// ErrInvalidPageSize is returned when the page size of Paginate is not positive.
+	ErrInvalidPageSize = errors.New("gonm: page size must be positive")
+	// ErrInvalidPageToken is returned when a page token is tampered or made for another query.
+	ErrInvalidPageToken = errors.New("gonm: invalid page token")
+	// ErrReadOnly is returned when a read-only transaction or Gonm of ReadAt writes entities.
+	ErrReadOnly = errors.New("gonm: gonm is read-only")
+	// ErrUnsupported is returned when the Backend of Gonm does not support the method.
+	// The backends other than Google Cloud Datastore return it for queries built by datastore.NewQuery
+	// with filters they cannot evaluate, such as OR, IN and != filters.
+	ErrUnsupported = backend.ErrUnsupported
+	// ErrInvalidQuery is returned when a query is invalid or not available for the method.
+	// The returned error is *QueryError.
+	ErrInvalidQuery = errors.New("gonm: invalid query")
 )
 
-func (gm *Gonm) stackError(err error) error {
+// InvalidTypeError describes a value of unexpected type passed to Gonm.
+// InvalidTypeError wraps ErrInvalidDestination.
+type InvalidTypeError struct {
+	// Type is the type of the passed value. Type is nil when the value is nil.
+	Type reflect.Type
+	// Expected describes the expected type.
+	Expected string
+}
+
+func invalidType(v interface{}, expected string) error {
+	return &InvalidTypeError{Type: reflect.TypeOf(v), Expected: expected}
+}
+
+func (e *InvalidTypeError) Error() string {
+	return fmt.Sprintf("gonm: expected %s, got %v", e.Expected, e.Type)
+}
+
+// Unwrap returns ErrInvalidDestination.
+func (e *InvalidTypeError) Unwrap() error {
+	return ErrInvalidDestination
+}
+
+// FieldError describes an invalid key field of struct.
+type FieldError struct {
+	// Type is the struct type.
+	Type reflect.Type
+	// Field is the field name.
+	Field string
+	// Tag is the key tag of the field, that is id, kind or parent.
+	Tag string
+	// Err is ErrDuplicateKeyField or ErrUnsupportedIDType.
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %s field %s in %v", e.Err, e.Tag, e.Field, e.Type)
+}
+
+// Unwrap returns e.Err.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// KeyError describes an invalid key generated from struct.
+type KeyError struct {
+	// Type is the struct type.
+	Type reflect.Type
+	// Key is the generated key.
+	Key *datastore.Key
+	// Err is the cause of the error such as ErrIncompleteKey.
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%v: %v %v", e.Err, e.Type, e.Key)
+}
+
+// Unwrap returns e.Err.
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// VersionConflictError describes a struct whose version field differs from the stored entity.
+// VersionConflictError wraps ErrVersionConflict.
+type VersionConflictError struct {
+	// Key is the key of the entity.
+	Key *datastore.Key
+	// Expected is the version of the struct.
+	Expected int64
+	// Actual is the version of the stored entity, which is 0 if the entity does not exist.
+	Actual int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v: %v expected version %d, got %d", ErrVersionConflict, e.Key, e.Expected, e.Actual)
+}
+
+// Unwrap returns ErrVersionConflict.
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// PropertyError describes a property of query that the struct does not have.
+// PropertyError wraps ErrUnknownProperty.
+type PropertyError struct {
+	// Type is the struct type.
+	Type reflect.Type
+	// Property is the property name.
+	Property string
+}
+
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("%v: %s in %v", ErrUnknownProperty, e.Property, e.Type)
+}
+
+// Unwrap returns ErrUnknownProperty.
+func (e *PropertyError) Unwrap() error {
+	return ErrUnknownProperty
+}
+
+// QueryError describes an invalid query.
+// QueryError wraps ErrInvalidQuery.
+type QueryError struct {
+	// Op is the name of the method that found the error, such as Filter or Paginate.
+	Op string
+	// Reason describes why the query is invalid.
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%v: %s: %s", ErrInvalidQuery, e.Op, e.Reason)
+}
+
+// Unwrap returns ErrInvalidQuery.
+func (e *QueryError) Unwrap() error {
+	return ErrInvalidQuery
+}
+
+// DefaultJournalSize is the number of errors that ErrorJournal keeps by default.
+const DefaultJournalSize = 100
+
+// JournalEntry is an error recorded in ErrorJournal.
+type JournalEntry struct {
+	// Time is the time when the error occurred.
+	Time time.Time
+	// Op is the name of the method of Gonm that returned the error.
+	Op string
+	// Keys are the keys that the method handled. Keys is nil when the keys are unknown.
+	Keys []*datastore.Key
+	// Err is the occurred error. Err has stack trace if stack capture is enabled.
+	Err error
+}
+
+// ErrorJournal keeps the latest errors occurred in methods of Gonm.
+//
+// ErrorJournal is a ring buffer, so the oldest entry is dropped when the journal is full.
+// ErrorJournal is safe for concurrent use.
+// The zero value keeps DefaultJournalSize errors, and a nil ErrorJournal records nothing.
+type ErrorJournal struct {
+	m       sync.Mutex
+	entries []JournalEntry
+	next    int
+	full    bool
+	noStack bool
+}
+
+// NewErrorJournal generate ErrorJournal which keeps at most size errors.
+func NewErrorJournal(size int) *ErrorJournal {
+	if size < 1 {
+		size = 1
+	}
+	return &ErrorJournal{entries: make([]JournalEntry, size)}
+}
+
+// Entries returns the recorded errors from oldest to newest.
+func (j *ErrorJournal) Entries() []JournalEntry {
+	if j == nil {
+		return nil
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if !j.full {
+		return append([]JournalEntry(nil), j.entries[:j.next]...)
+	}
+	entries := make([]JournalEntry, 0, len(j.entries))
+	entries = append(entries, j.entries[j.next:]...)
+	return append(entries, j.entries[:j.next]...)
+}
+
+// Len returns the number of recorded errors.
+func (j *ErrorJournal) Len() int {
+	if j == nil {
+		return 0
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if j.full {
+		return len(j.entries)
+	}
+	return j.next
+}
+
+// Reset removes all recorded errors.
+func (j *ErrorJournal) Reset() {
+	if j == nil {
+		return
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	j.entries = make([]JournalEntry, len(j.entries))
+	j.next = 0
+	j.full = false
+}
+
+// SetStackCapture switches whether the journal records errors with stack trace.
+// Capturing stack trace is enabled by default. Disabling it reduces the cost of errors in hot paths.
+func (j *ErrorJournal) SetStackCapture(enable bool) {
+	if j == nil {
+		return
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	j.noStack = !enable
+}
+
+func (j *ErrorJournal) record(op string, keys []*datastore.Key, err error) {
+	if j == nil {
+		return
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if len(j.entries) == 0 {
+		j.entries = make([]JournalEntry, DefaultJournalSize)
+	}
+	if !j.noStack {
+		err = errors.WithStack(err)
+	}
+	j.entries[j.next] = JournalEntry{
+		Time: time.Now(),
+		Op:   op,
+		Keys: keys,
+		Err:  err,
+	}
+	j.next++
+	if j.next == len(j.entries) {
+		j.next = 0
+		j.full = true
+	}
+}
+
+// stackError records err of op into the error journal of gm and returns err as it is.
+func (gm *Gonm) stackError(op string, keys []*datastore.Key, err error) error {
 	if err == nil {
 		panic("gonm: err is nil")
 	}
-	gm.m.Lock()
-	defer gm.m.Unlock()
-
-	gm.Errors = append(gm.Errors, errors.WithStack(err))
+	gm.Errors.record(op, keys, err)
 	return err
 }
 
@@ -42,11 +327,11 @@ func (gm *Gonm) printStackErrs(err error) string {
 		panic("gonm: err is nil")
 	}
 	str := printErr(err)
-	for _, e := range gm.Errors {
-		if e == err {
+	for _, e := range gm.Errors.Entries() {
+		if errors.Cause(e.Err) == err {
 			continue
 		}
-		str += printErr(e)
+		str += fmt.Sprintf("%s: ", e.Op) + printErr(e.Err)
 	}
 	return str
 }
@@ -0,0 +1,45 @@
+package gonm
+
+import (
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorJournal(t *testing.T) {
+	assert := assert.New(t)
+	journal := NewErrorJournal(2)
+
+	key := datastore.IDKey("testModel", 1, nil)
+	err1, err2, err3 := errors.New("err1"), errors.New("err2"), errors.New("err3")
+	journal.record("Get", []*datastore.Key{key}, err1)
+	journal.record("Put", nil, err2)
+	journal.record("Delete", nil, err3)
+
+	entries := journal.Entries()
+	assert.Len(entries, 2, "oldest entry is dropped")
+	assert.Equal("Put", entries[0].Op)
+	assert.Equal("Delete", entries[1].Op)
+	assert.Equal(err3.Error(), entries[1].Err.Error())
+	assert.False(entries[1].Time.IsZero(), "entry has time")
+
+	journal.Reset()
+	assert.Equal(0, journal.Len(), "reset journal")
+
+	journal.SetStackCapture(false)
+	journal.record("Get", []*datastore.Key{key}, err1)
+	entries = journal.Entries()
+	assert.Equal(err1, entries[0].Err, "error without stack")
+	assert.Equal(key, entries[0].Keys[0])
+
+	var nilJournal *ErrorJournal
+	nilJournal.record("Get", nil, err1)
+	assert.Equal(0, nilJournal.Len(), "nil journal records nothing")
+	assert.Nil(nilJournal.Entries())
+
+	zero := &ErrorJournal{}
+	zero.record("Get", nil, err1)
+	assert.Equal(1, zero.Len(), "zero journal records errors")
+}
@@ -11,8 +11,10 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -21,33 +23,157 @@ var datastorePutMultiMaxItems = 500
 // Gonm is main struct
 type Gonm struct {
 	// Client store generated datastore.Client. Datastore.Client close when Gonm.Close.
-	// In transaction, Client is nil.
+	// In transaction or not on Google Cloud Datastore, Client is nil.
 	Client *datastore.Client
 
 	// Transaction store generated datastore.Transaction.
-	// In not transaction, Transaction is nil.
+	// In not transaction or not on Google Cloud Datastore, Transaction is nil.
 	Transaction *datastore.Transaction
 
-	// Errors store occurred error in method of Gonm.
-	Errors datastore.MultiError
+	// Errors keeps the latest errors occurred in methods of Gonm.
+	// Gonm in transaction shares Errors with the Gonm that started the transaction.
+	// Errors used to be datastore.MultiError keeping every error; read Errors.Entries instead.
+	Errors *ErrorJournal
+
+	// PageTokenKey is the key to sign page tokens of Paginate.
+	PageTokenKey []byte
+
+	// RetryPolicy decides how RunInTransaction retries. If RetryPolicy is nil,
+	// RunInTransaction retries as the Backend does.
+	RetryPolicy *RetryPolicy
+
+	// JoinTransaction makes RunInTransaction in transaction run in the outer transaction.
+	// If JoinTransaction is false, RunInTransaction in transaction returns ErrNestedTransaction.
+	JoinTransaction bool
 
 	Context context.Context
+	backend backend.Backend
+	tx      backend.Transaction
 	cache   *cache
-	pending []*pendingStruct
-	m       sync.Mutex
+	pending *pendingList
+	// readOnly is true in read-only transaction and in Gonm of ReadAt.
+	readOnly bool
+	// readTime is the time at which Gonm of ReadAt reads entities.
+	readTime time.Time
 }
 
 type pendingStruct struct {
-	pkey *datastore.PendingKey
+	pkey backend.PendingKey
 	dst  interface{}
 }
 
+// pendingList keeps structures whose keys are completed on commit,
+// keys which are removed from the cache on commit, and hooks of the transaction.
+type pendingList struct {
+	m           sync.Mutex
+	list        []*pendingStruct
+	invalidated []*datastore.Key
+	onCommit    []func(*datastore.Commit)
+	onRollback  []func(error)
+	versions    []versionedStruct
+	// failed is the error of RunInTransaction which joined the transaction.
+	// The transaction is rolled back if failed is not nil.
+	failed error
+}
+
+func (pl *pendingList) add(pkey backend.PendingKey, dst interface{}) {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+
+	pl.list = append(pl.list, &pendingStruct{pkey: pkey, dst: dst})
+}
+
+func (pl *pendingList) invalidate(key *datastore.Key) {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+
+	pl.invalidated = append(pl.invalidated, key)
+}
+
+// joinedError returns the error of RunInTransaction which joined the transaction.
+func (pl *pendingList) joinedError() error {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+
+	return pl.failed
+}
+
+// invalidate removes key from the cache.
+// In transaction, key is removed when the transaction is committed.
+func (gm *Gonm) invalidate(key *datastore.Key) {
+	if gm.tx != nil {
+		gm.pending.invalidate(key)
+		return
+	}
+	gm.cache.delete(key)
+}
+
+// batchError collects the errors of batched operations.
+// Entry i of the resulting datastore.MultiError corresponds to input i.
+type batchError struct {
+	m     sync.Mutex
+	errs  datastore.MultiError
+	multi bool
+}
+
+func newBatchError(n int) *batchError {
+	return &batchError{errs: make(datastore.MultiError, n)}
+}
+
+// set records err of the batch [lo, hi).
+func (be *batchError) set(lo, hi int, err error) {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	if merr, ok := err.(datastore.MultiError); ok && len(merr) == hi-lo {
+		copy(be.errs[lo:hi], merr)
+		be.multi = true
+		return
+	}
+	for i := lo; i < hi; i++ {
+		be.errs[i] = err
+	}
+}
+
+// result returns datastore.MultiError if any batch returned datastore.MultiError, otherwise err.
+func (be *batchError) result(err error) error {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	if be.multi {
+		return be.errs
+	}
+	return err
+}
+
 // FromContext generate Gonm from Context.
 func FromContext(ctx context.Context, dsClient *datastore.Client) *Gonm {
+	return fromBackend(ctx, &datastoreBackend{client: dsClient})
+}
+
+// WithContext returns Gonm whose methods use ctx.
+//
+// The returned Gonm shares Backend, Transaction, cache and Errors with gm,
+// so each operation can carry its own deadline and cancellation without losing the cache.
+// In transaction, operations of the transaction keep using the Context of the transaction.
+func (gm *Gonm) WithContext(ctx context.Context) *Gonm {
+	if ctx == nil {
+		panic("gonm: nil context")
+	}
 	return &Gonm{
-		Context: ctx,
-		Client:  dsClient,
-		cache:   newCache(),
+		Context:         ctx,
+		Client:          gm.Client,
+		Transaction:     gm.Transaction,
+		Errors:          gm.Errors,
+		PageTokenKey:    gm.PageTokenKey,
+		RetryPolicy:     gm.RetryPolicy,
+		JoinTransaction: gm.JoinTransaction,
+		backend:         gm.backend,
+		tx:              gm.tx,
+		cache:           gm.cache,
+		pending:         gm.pending,
+		readOnly:        gm.readOnly,
+		readTime:        gm.readTime,
 	}
 }
 
@@ -58,7 +184,7 @@ func FromContext(ctx context.Context, dsClient *datastore.Client) *Gonm {
 func (gm *Gonm) AllocateID(dst interface{}) (*datastore.Key, error) {
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
-		return nil, gm.stackError(fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst))
+		return nil, gm.stackError("AllocateID", nil, invalidType(dst, "pointer to a struct"))
 	}
 	keys, err := gm.AllocateIDs([]interface{}{dst})
 	if err != nil {
@@ -66,7 +192,7 @@ func (gm *Gonm) AllocateID(dst interface{}) (*datastore.Key, error) {
 	}
 
 	if len(keys) == 0 {
-		return nil, gm.stackError(fmt.Errorf("gonm: not allocate id"))
+		return nil, gm.stackError("AllocateID", nil, ErrNotAllocated)
 	}
 	return keys[0], nil
 }
@@ -76,22 +202,22 @@ func (gm *Gonm) AllocateID(dst interface{}) (*datastore.Key, error) {
 //
 // Also, all structures are complemented with IDs.
 func (gm *Gonm) AllocateIDs(dst interface{}) ([]*datastore.Key, error) {
-	if gm.Transaction != nil {
-		return nil, gm.stackError(ErrInTransaction)
+	if gm.tx != nil {
+		return nil, gm.stackError("AllocateIDs", nil, ErrInTransaction)
 	}
 	keys, err := extractKeys(dst, true)
 	if err != nil {
-		return nil, gm.stackError(err)
+		return nil, gm.stackError("AllocateIDs", nil, err)
 	}
-	keys, err = gm.Client.AllocateIDs(gm.Context, keys)
+	keys, err = gm.backend.AllocateIDs(gm.Context, keys)
 	if err != nil {
-		return nil, gm.stackError(err)
+		return nil, gm.stackError("AllocateIDs", nil, err)
 	}
 
 	v := reflect.Indirect(reflect.ValueOf(dst))
 	for i, key := range keys {
 		if err := setStructKey(v.Index(i).Interface(), key); err != nil {
-			return nil, gm.stackError(err)
+			return nil, gm.stackError("AllocateIDs", []*datastore.Key{key}, err)
 		}
 	}
 	return keys, nil
@@ -99,14 +225,14 @@ func (gm *Gonm) AllocateIDs(dst interface{}) ([]*datastore.Key, error) {
 
 // Close close the Gonm
 func (gm *Gonm) Close() error {
-	if gm.Transaction != nil {
-		return fmt.Errorf("gonm: Close do not use in Transaction")
+	if gm.tx != nil {
+		return ErrInTransaction
 	}
-	if err := gm.Client.Close(); err != nil {
+	if err := gm.backend.Close(); err != nil {
 		return err
 	}
 	gm.cache = nil
-	gm.Errors = nil
+	gm.Errors.Reset()
 	return nil
 }
 
@@ -114,7 +240,7 @@ func (gm *Gonm) Close() error {
 func (gm *Gonm) Delete(dst interface{}) error {
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
-		return gm.stackError(fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst))
+		return gm.stackError("Delete", nil, invalidType(dst, "pointer to a struct"))
 	}
 	err := gm.DeleteMulti([]interface{}{dst})
 	if err != nil {
@@ -128,13 +254,24 @@ func (gm *Gonm) Delete(dst interface{}) error {
 
 // DeleteMulti deletes the entity for the given []*S or []S.
 func (gm *Gonm) DeleteMulti(dst interface{}) error {
+	if gm.readOnly {
+		return gm.stackError("DeleteMulti", nil, ErrReadOnly)
+	}
 	keys, err := extractKeys(dst, false) // allow incomplete keys on a Put request
 	if err != nil {
-		return gm.stackError(err)
+		return gm.stackError("DeleteMulti", nil, err)
+	}
+	return gm.deleteMultiByKeys("DeleteMulti", keys)
+}
+
+// deleteMultiByKeys deletes the entities of keys in batches and removes them from the cache.
+func (gm *Gonm) deleteMultiByKeys(op string, keys []*datastore.Key) error {
+	if gm.readOnly {
+		return gm.stackError(op, nil, ErrReadOnly)
 	}
 
 	goroutines := (len(keys)-1)/datastorePutMultiMaxItems + 1
-	var multiError datastore.MultiError
+	multiError := newBatchError(len(keys))
 
 	var eg errgroup.Group
 	for i := 0; i < goroutines; i++ {
@@ -147,20 +284,18 @@ func (gm *Gonm) DeleteMulti(dst interface{}) error {
 			}
 
 			for _, key := range keys[lo:hi] {
-				gm.cache.delete(key)
+				gm.invalidate(key)
 			}
 
 			var err error
-			if gm.Transaction != nil {
-				err = gm.Transaction.DeleteMulti(keys[lo:hi])
+			if gm.tx != nil {
+				err = gm.tx.DeleteMulti(keys[lo:hi])
 			} else {
-				err = gm.Client.DeleteMulti(gm.Context, keys[lo:hi])
+				err = gm.backend.DeleteMulti(gm.Context, keys[lo:hi])
 			}
 			if err != nil {
-				if merr, ok := err.(datastore.MultiError); ok {
-					multiError = append(multiError, merr...)
-				}
-				return gm.stackError(err)
+				multiError.set(lo, hi, err)
+				return gm.stackError(op, keys[lo:hi], err)
 			}
 
 			return nil
@@ -168,7 +303,7 @@ func (gm *Gonm) DeleteMulti(dst interface{}) error {
 	}
 
 	if err := eg.Wait(); err != nil {
-		return err
+		return multiError.result(err)
 	}
 
 	return nil
@@ -190,7 +325,7 @@ func (gm *Gonm) GetConsistency(dst interface{}) error {
 func (gm *Gonm) get(dst interface{}, cache bool) error {
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
-		return gm.stackError(fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst))
+		return gm.stackError("Get", nil, invalidType(dst, "pointer to a struct"))
 	}
 
 	var err error
@@ -217,7 +352,7 @@ func (gm *Gonm) get(dst interface{}, cache bool) error {
 func (gm *Gonm) GetByKey(key *datastore.Key, dst interface{}) error {
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
-		return gm.stackError(fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst))
+		return gm.stackError("GetByKey", nil, invalidType(dst, "pointer to a struct"))
 	}
 
 	if err := gm.GetMultiByKeys([]*datastore.Key{key}, []interface{}{dst}); err != nil {
@@ -236,7 +371,7 @@ func (gm *Gonm) GetByKey(key *datastore.Key, dst interface{}) error {
 func (gm *Gonm) GetMulti(dst interface{}) error {
 	keys, err := extractKeys(dst, false)
 	if err != nil {
-		return gm.stackError(err)
+		return gm.stackError("GetMulti", nil, err)
 	}
 	return gm.GetMultiByKeys(keys, dst)
 }
@@ -245,7 +380,7 @@ func (gm *Gonm) GetMulti(dst interface{}) error {
 func (gm *Gonm) GetMultiConsistency(dst interface{}) error {
 	keys, err := extractKeys(dst, false)
 	if err != nil {
-		return gm.stackError(err)
+		return gm.stackError("GetMultiConsistency", nil, err)
 	}
 	return gm.getMultiByKeysConsistency(keys, dst)
 }
@@ -255,13 +390,14 @@ func (gm *Gonm) GetMultiConsistency(dst interface{}) error {
 // Usage is almost the same as datastore.Client.GetMulti.
 // this method use cache
 func (gm *Gonm) GetMultiByKeys(keys []*datastore.Key, dst interface{}) error {
-	if gm.Transaction != nil {
+	if gm.tx != nil || !gm.readTime.IsZero() {
 		return gm.getMultiByKeysConsistency(keys, dst)
 	}
 
 	v := reflect.Indirect(reflect.ValueOf(dst))
 
 	var getKeys []*datastore.Key
+	var getIndexes []int
 	var dstList []interface{}
 
 	for i, key := range keys {
@@ -294,18 +430,77 @@ func (gm *Gonm) GetMultiByKeys(keys []*datastore.Key, dst interface{}) error {
 			}
 		} else {
 			getKeys = append(getKeys, key)
+			getIndexes = append(getIndexes, i)
 			dstList = append(dstList, vi.Interface())
 		}
 	}
 
-	return gm.getMultiByKeysConsistency(getKeys, dstList)
+	err := gm.getMultiByKeysConsistency(getKeys, dstList)
+	if merr, ok := err.(datastore.MultiError); ok {
+		// map errors of getKeys back to the positions of keys
+		multiError := make(datastore.MultiError, len(keys))
+		for i, e := range merr {
+			multiError[getIndexes[i]] = e
+		}
+		return multiError
+	}
+	return err
+}
+
+// GetMultiPartial is GetMulti which treats datastore.ErrNoSuchEntity as a per-item status.
+//
+// found[i] reports whether dst[i] was loaded.
+// Err is not nil only if an item failed for a reason other than datastore.ErrNoSuchEntity,
+// and then err is datastore.MultiError whose entry i corresponds to dst[i].
+func (gm *Gonm) GetMultiPartial(dst interface{}) (found []bool, err error) {
+	keys, err := extractKeys(dst, false)
+	if err != nil {
+		return nil, gm.stackError("GetMultiPartial", nil, err)
+	}
+	return gm.GetMultiByKeysPartial(keys, dst)
+}
+
+// GetMultiByKeysPartial is GetMultiByKeys which treats datastore.ErrNoSuchEntity as a per-item status.
+//
+// Found and err are the same as GetMultiPartial.
+func (gm *Gonm) GetMultiByKeysPartial(keys []*datastore.Key, dst interface{}) (found []bool, err error) {
+	found = make([]bool, len(keys))
+	err = gm.GetMultiByKeys(keys, dst)
+	if err == nil {
+		for i := range found {
+			found[i] = true
+		}
+		return found, nil
+	}
+
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		return nil, err
+	}
+	failed := false
+	for i, e := range merr {
+		switch e {
+		case nil:
+			found[i] = true
+		case datastore.ErrNoSuchEntity:
+		default:
+			failed = true
+		}
+	}
+	if failed {
+		return found, merr
+	}
+	return found, nil
 }
 
 // getMultiByKeysConsistency is simple wrapper of datastore Client GetMulti
 func (gm *Gonm) getMultiByKeysConsistency(keys []*datastore.Key, dst interface{}) error {
+	if len(keys) == 0 {
+		return nil
+	}
 	v := reflect.Indirect(reflect.ValueOf(dst))
 	goroutines := (len(keys)-1)/datastorePutMultiMaxItems + 1
-	var multiError datastore.MultiError
+	multiError := newBatchError(len(keys))
 
 	var eg errgroup.Group
 	for i := 0; i < goroutines; i++ {
@@ -318,27 +513,32 @@ func (gm *Gonm) getMultiByKeysConsistency(keys []*datastore.Key, dst interface{}
 			}
 
 			var err error
-			if gm.Transaction != nil {
-				for _, key := range keys[lo:hi] {
-					gm.cache.delete(key)
+			switch {
+			case gm.tx != nil:
+				if !gm.readOnly {
+					for _, key := range keys[lo:hi] {
+						gm.invalidate(key)
+					}
 				}
-				err = gm.Transaction.GetMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
+				err = gm.tx.GetMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
 				if err != nil {
-					if merr, ok := err.(datastore.MultiError); ok {
-						multiError = append(multiError, merr...)
-					}
-					return gm.stackError(err)
+					multiError.set(lo, hi, err)
+					return gm.stackError("GetMulti", keys[lo:hi], err)
 				}
-			} else {
-				err = gm.Client.GetMulti(gm.Context, keys[lo:hi], v.Slice(lo, hi).Interface())
+			case !gm.readTime.IsZero():
+				err = gm.backend.GetMultiAt(gm.Context, gm.readTime, keys[lo:hi], v.Slice(lo, hi).Interface())
 				if err != nil {
-					if merr, ok := err.(datastore.MultiError); ok {
-						multiError = append(multiError, merr...)
-					}
+					multiError.set(lo, hi, err)
+					return gm.stackError("GetMulti", keys[lo:hi], err)
+				}
+			default:
+				err = gm.backend.GetMulti(gm.Context, keys[lo:hi], v.Slice(lo, hi).Interface())
+				if err != nil {
+					multiError.set(lo, hi, err)
 					for _, key := range keys[lo:hi] {
 						gm.cache.delete(key)
 					}
-					return gm.stackError(err)
+					return gm.stackError("GetMulti", keys[lo:hi], err)
 				}
 
 				for i, key := range keys[lo:hi] {
@@ -351,10 +551,7 @@ func (gm *Gonm) getMultiByKeysConsistency(keys []*datastore.Key, dst interface{}
 	}
 
 	if err := eg.Wait(); err != nil {
-		if len(multiError) > 0 {
-			return multiError
-		}
-		return err
+		return multiError.result(err)
 	}
 
 	return nil
@@ -368,7 +565,7 @@ func (gm *Gonm) getMultiByKeysConsistency(keys []*datastore.Key, dst interface{}
 func (gm *Gonm) Put(src interface{}) (*datastore.Key, error) {
 	v := reflect.ValueOf(src)
 	if v.Kind() != reflect.Ptr {
-		return nil, gm.stackError(fmt.Errorf("gonm: expected pointer to a struct, got %#v", src))
+		return nil, gm.stackError("Put", nil, invalidType(src, "pointer to a struct"))
 	}
 	ks, err := gm.PutMulti([]interface{}{src})
 	if err != nil {
@@ -385,14 +582,37 @@ func (gm *Gonm) Put(src interface{}) (*datastore.Key, error) {
 //
 // Also, all structures are complemented with IDs after this method.
 func (gm *Gonm) PutMulti(src interface{}) ([]*datastore.Key, error) {
+	if gm.readOnly {
+		return nil, gm.stackError("PutMulti", nil, ErrReadOnly)
+	}
 	keys, err := extractKeys(src, true) // allow incomplete keys on a Put request
 	if err != nil {
-		return nil, gm.stackError(err)
+		return nil, gm.stackError("PutMulti", nil, err)
 	}
 
 	v := reflect.Indirect(reflect.ValueOf(src))
+	var versions []versionedStruct
+	if hasVersionField(v) {
+		if gm.tx == nil {
+			// version fields are checked and incremented only in transaction
+			_, err := gm.RunInTransaction(func(tx *Gonm) error {
+				_, err := tx.PutMulti(src)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			return extractKeys(src, true)
+		}
+		versions, err = gm.checkVersions(keys, structValues(v))
+		if err != nil {
+			return nil, gm.stackError("PutMulti", keys, err)
+		}
+		defer setVersions(versions)()
+	}
+
 	goroutines := (len(keys)-1)/datastorePutMultiMaxItems + 1
-	var multiError datastore.MultiError
+	multiError := newBatchError(len(keys))
 
 	var eg errgroup.Group
 	for i := 0; i < goroutines; i++ {
@@ -406,50 +626,40 @@ func (gm *Gonm) PutMulti(src interface{}) ([]*datastore.Key, error) {
 
 			var (
 				rkeys []*datastore.Key
-				pkeys []*datastore.PendingKey
+				pkeys []backend.PendingKey
 				err   error
 			)
-			if gm.Transaction != nil {
-				pkeys, err = gm.Transaction.PutMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
+			if gm.tx != nil {
+				pkeys, err = gm.tx.PutMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
 				if err != nil {
-					if merr, ok := err.(datastore.MultiError); ok {
-						multiError = append(multiError, merr...)
-					}
+					multiError.set(lo, hi, err)
 					for _, key := range keys[lo:hi] {
 						if !key.Incomplete() {
-							gm.cache.delete(key)
+							gm.invalidate(key)
 						}
 					}
-					return gm.stackError(err)
+					return gm.stackError("PutMulti", keys[lo:hi], err)
 				}
 
 				for i, key := range keys[lo:hi] {
 					vi := v.Slice(lo, hi)
 					if key.Incomplete() {
-						gm.m.Lock()
-						gm.pending = append(gm.pending,
-							&pendingStruct{
-								pkey: pkeys[i],
-								dst:  vi.Index(i).Interface(),
-							})
-						gm.m.Unlock()
+						gm.pending.add(pkeys[i], vi.Index(i).Interface())
 					} else {
-						gm.cache.delete(key)
+						gm.invalidate(key)
 					}
 				}
 
 			} else {
-				rkeys, err = gm.Client.PutMulti(gm.Context, keys[lo:hi], v.Slice(lo, hi).Interface())
+				rkeys, err = gm.backend.PutMulti(gm.Context, keys[lo:hi], v.Slice(lo, hi).Interface())
 				if err != nil {
-					if merr, ok := err.(datastore.MultiError); ok {
-						multiError = append(multiError, merr...)
-					}
+					multiError.set(lo, hi, err)
 					for _, key := range keys[lo:hi] {
 						if !key.Incomplete() {
 							gm.cache.delete(key)
 						}
 					}
-					return gm.stackError(err)
+					return gm.stackError("PutMulti", keys[lo:hi], err)
 				}
 
 				for i, key := range keys[lo:hi] {
@@ -468,10 +678,10 @@ func (gm *Gonm) PutMulti(src interface{}) ([]*datastore.Key, error) {
 	}
 
 	if err := eg.Wait(); err != nil {
-		if len(multiError) > 0 {
-			return keys, multiError
-		}
-		return keys, err
+		return keys, multiError.result(err)
+	}
+	if versions != nil {
+		gm.pending.addVersions(versions)
 	}
 
 	return keys, nil
@@ -27,6 +27,7 @@ func BenchmarkSimpleGet(b *testing.B) {
 	ctx := context.Background()
 
 	var err error
+	requireDatastore(b)
 	gm := FromContext(ctx, testDsClient)
 
 	var keys []*datastore.Key
@@ -64,6 +65,7 @@ func BenchmarkGonm_GetConsistency(b *testing.B) {
 	ctx := context.Background()
 
 	var err error
+	requireDatastore(b)
 	gm := FromContext(ctx, testDsClient)
 
 	putModel := setupModel(true)
@@ -85,6 +87,7 @@ func BenchmarkGonm_Get(b *testing.B) {
 	ctx := context.Background()
 
 	var err error
+	requireDatastore(b)
 	gm := FromContext(ctx, testDsClient)
 
 	putModel := setupModel(true)
@@ -106,6 +109,7 @@ func BenchmarkSimplePut(b *testing.B) {
 	ctx := context.Background()
 
 	var err error
+	requireDatastore(b)
 	gm := FromContext(ctx, testDsClient)
 
 	var eg errgroup.Group
@@ -141,6 +145,7 @@ func BenchmarkGonm_Put(b *testing.B) {
 	ctx := context.Background()
 
 	var err error
+	requireDatastore(b)
 	gm := FromContext(ctx, testDsClient)
 
 	putModel := setupModel(true)
@@ -17,7 +17,7 @@ func TestGonm_AllocateIDs(t *testing.T) {
 	assert := assert.New(t)
 	ctx := context.Background()
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	test := []*testModel{
 		{Name: "Michel"},
@@ -45,7 +45,7 @@ func TestGonm_DeleteMulti(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	putModel := []*testModel{
 		{ID: 1, Name: "Michael"},
@@ -69,7 +69,7 @@ func TestGonm_PutGet(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	putModel := &testModel{Name: "Tom"}
 	if _, err = gm.Put(putModel); err != nil {
@@ -108,7 +108,7 @@ func TestGonm_PutGetMulti(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	t.Run("get multi stackError", func(t *testing.T) {
 		var largeModel []*testModel
@@ -127,6 +127,56 @@ func TestGonm_PutGetMulti(t *testing.T) {
 		}
 	})
 
+	t.Run("get multi error position", func(t *testing.T) {
+		defer func(n int) { datastorePutMultiMaxItems = n }(datastorePutMultiMaxItems)
+		datastorePutMultiMaxItems = 2
+
+		if _, err = gm.PutMulti([]*testModel{{ID: 1, Name: "Michael"}, {ID: 2, Name: "Tom"}}); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+
+		getModel := []*testModel{{ID: 1}, {ID: 999999}, {ID: 999998}, {ID: 2}, {ID: 999997}}
+		err = gm.GetMultiConsistency(getModel)
+		merr, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("error is not MultiError")
+		}
+		assert.Len(t, merr, len(getModel), "one error per input")
+		assert.NoError(t, merr[0], "exist entity")
+		assert.Equal(t, datastore.ErrNoSuchEntity, merr[1], "missing entity")
+		assert.Equal(t, datastore.ErrNoSuchEntity, merr[2], "missing entity")
+		assert.NoError(t, merr[3], "exist entity")
+		assert.Equal(t, datastore.ErrNoSuchEntity, merr[4], "missing entity")
+	})
+
+	t.Run("get multi partial with cache", func(t *testing.T) {
+		if _, err = gm.PutMulti([]*testModel{{ID: 1, Name: "Michael"}, {ID: 2, Name: "Tom"}}); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		if err = gm.Get(&testModel{ID: 2}); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+
+		getModel := []*testModel{{ID: 1}, {ID: 2}, {ID: 999999}}
+		err = gm.GetMulti(getModel)
+		merr, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("error is not MultiError")
+		}
+		assert.Len(t, merr, len(getModel), "one error per input")
+		assert.NoError(t, merr[1], "cached entity")
+		assert.Equal(t, datastore.ErrNoSuchEntity, merr[2], "missing entity")
+
+		getModel = []*testModel{{ID: 1}, {ID: 999999}, {ID: 2}}
+		found, err := gm.GetMultiPartial(getModel)
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal(t, []bool{true, false, true}, found, "found entities")
+		assert.Equal(t, "Michael", getModel[0].Name, "uncached entity")
+		assert.Equal(t, "Tom", getModel[2].Name, "cached entity")
+	})
+
 	t.Run("addr put addr get", func(t *testing.T) {
 		putModel := []*testModel{
 			{ID: 1, Name: "Michael"},
@@ -246,3 +296,34 @@ func TestGonm_PutGetMulti(t *testing.T) {
 		assert.Equal(t, putModel[0].Name, getModel[0].Name, "gostore GetMulti")
 	})
 }
+
+func TestGonm_WithContext(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var err error
+	gm := newTestGonm(ctx)
+
+	putModel := &testModel{ID: 1, Name: "Michael"}
+	if _, err = gm.Put(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	cgm := gm.WithContext(cctx)
+
+	getModel := &testModel{ID: 1}
+	if err = cgm.Get(getModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel, getModel, "share cache")
+
+	_, err = cgm.Put(&testModel{ID: 2, Name: "Tom"})
+	assert.Error(err, "canceled context")
+	assert.Equal(1, gm.Errors.Len(), "share errors")
+
+	if _, err = gm.Put(&testModel{ID: 2, Name: "Tom"}); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+}
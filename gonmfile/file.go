@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * Package gonmfile provides the backend of Gonm which persists entities to a single file.
+ */
+
+package gonmfile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/komem3/gonm/internal/memstore"
+)
+
+var (
+	// ErrInvalidFile is returned when opening a file which is not written by Backend.
+	ErrInvalidFile = errors.New("gonmfile: invalid file")
+	// ErrClosed is returned when writing to a closed Backend.
+	ErrClosed = errors.New("gonmfile: backend is closed")
+)
+
+// magic is the header of the file.
+var magic = []byte("GONMFILE1\n")
+
+// recordHeaderSize is the size of the length and the checksum of a record.
+const recordHeaderSize = 8
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(&datastore.Key{})
+	gob.Register(datastore.GeoPoint{})
+	gob.Register(&datastore.Entity{})
+	gob.Register([]interface{}{})
+}
+
+// record is a committed change of entities.
+type record struct {
+	Changes []memstore.Change
+	NextID  int64
+}
+
+// Backend is the backend of Gonm which persists entities to a single file.
+//
+// The file is an append-only log of committed changes, and every commit is synced to disk.
+// All entities are kept on memory, and queries and transactions behave like gonmtest.Memory.
+// The file must not be opened by more than one Backend at the same time.
+type Backend struct {
+	store *memstore.Store
+
+	m    sync.Mutex
+	path string
+	f    *os.File
+	// size is the size of the valid records in the file.
+	size int64
+	err  error
+}
+
+// Open opens the file of path and restores the entities.
+// If the file does not exist, Open creates it.
+func Open(path string) (*Backend, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{path: path, f: f}
+	b.store = memstore.New(memstore.Options{Persist: b.persist})
+	if err := b.load(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Gonm generate Gonm running on b. Gonm.Close closes b.
+func (b *Backend) Gonm(ctx context.Context) *gonm.Gonm {
+	return backend.NewGonm(ctx, storage{Store: b.store, b: b}).(*gonm.Gonm)
+}
+
+// Len returns the number of entities in b.
+func (b *Backend) Len() int {
+	return b.store.Len()
+}
+
+// storage is the backend.Backend of Backend, which closes the file on Close.
+type storage struct {
+	*memstore.Store
+	b *Backend
+}
+
+func (s storage) Close() error {
+	return s.b.Close()
+}
+
+// load restores the entities from the file.
+// A torn record at the end of the file, which is left by a crash while writing, is removed.
+func (b *Backend) load() error {
+	info, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := b.f.Write(magic); err != nil {
+			return err
+		}
+		b.size = int64(len(magic))
+		return b.f.Sync()
+	}
+
+	r := bufio.NewReader(b.f)
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header, magic) {
+		return ErrInvalidFile
+	}
+	b.size = int64(len(magic))
+
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errChecksum {
+			if err := b.f.Truncate(b.size); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		b.store.Restore(rec.Changes, rec.NextID)
+		b.size += n
+	}
+	_, err = b.f.Seek(b.size, io.SeekStart)
+	return err
+}
+
+// persist appends a record of changes to the file.
+func (b *Backend) persist(changes []memstore.Change, nextID int64) error {
+	data, err := encodeRecord(changes, nextID)
+	if err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+
+	if _, err := b.f.Write(data); err != nil {
+		b.discard()
+		return err
+	}
+	if err := b.f.Sync(); err != nil {
+		b.discard()
+		return err
+	}
+	b.size += int64(len(data))
+	return nil
+}
+
+// discard removes a record which failed to be written. The caller must hold b.m.
+// If it cannot be removed, the later writes would be lost, so Backend stops writing.
+func (b *Backend) discard() {
+	if err := b.f.Truncate(b.size); err != nil {
+		b.err = err
+		return
+	}
+	if _, err := b.f.Seek(b.size, io.SeekStart); err != nil {
+		b.err = err
+	}
+}
+
+// Compact rewrites the file with only the current entities.
+// The log grows with every commit, so Compact is used to reclaim the space of overwritten and deleted entities.
+func (b *Backend) Compact() error {
+	return b.store.Snapshot(func(entities []memstore.Change, nextID int64) error {
+		b.m.Lock()
+		defer b.m.Unlock()
+		if b.err != nil {
+			return b.err
+		}
+
+		data, err := encodeRecord(entities, nextID)
+		if err != nil {
+			return err
+		}
+		tmp := b.path + ".tmp"
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(f, data); err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, b.path); err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		_ = b.f.Close()
+		b.f = f
+		b.size = int64(len(magic) + len(data))
+		return nil
+	})
+}
+
+func writeFile(f *os.File, data []byte) error {
+	if _, err := f.Write(magic); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Close closes the file.
+func (b *Backend) Close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.err == ErrClosed {
+		return nil
+	}
+	b.err = ErrClosed
+	return b.f.Close()
+}
+
+var errChecksum = errors.New("gonmfile: checksum mismatch")
+
+// encodeRecord returns the bytes of a record: the length and the checksum of the payload, and the payload.
+func encodeRecord(changes []memstore.Change, nextID int64) ([]byte, error) {
+	rec := record{Changes: make([]memstore.Change, len(changes)), NextID: nextID}
+	for i, change := range changes {
+		rec.Changes[i] = memstore.Change{Key: change.Key, Properties: gobProperties(change.Properties), Deleted: change.Deleted}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, recordHeaderSize))
+	if err := gob.NewEncoder(buf).Encode(&rec); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	payload := data[recordHeaderSize:]
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	return data, nil
+}
+
+// readRecord reads a record and returns it with its size.
+func readRecord(r io.Reader) (*record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errChecksum
+	}
+
+	var rec record
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return nil, 0, err
+	}
+	return &rec, int64(recordHeaderSize + len(payload)), nil
+}
+
+// gobProperties returns the copy of props which gob can encode.
+// gob cannot encode nil pointers in interface values, so they are replaced with nil.
+func gobProperties(props []datastore.Property) []datastore.Property {
+	if props == nil {
+		return nil
+	}
+	ret := make([]datastore.Property, len(props))
+	for i, prop := range props {
+		ret[i] = prop
+		ret[i].Value = gobValue(prop.Value)
+	}
+	return ret
+}
+
+func gobValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, e := range v {
+			ret[i] = gobValue(e)
+		}
+		return ret
+	case *datastore.Entity:
+		if v == nil {
+			return nil
+		}
+		return &datastore.Entity{Key: v.Key, Properties: gobProperties(v.Properties)}
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	return v
+}
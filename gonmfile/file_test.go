@@ -0,0 +1,190 @@
+package gonmfile
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm"
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	ID        int64          `datastore:"-"`
+	Parent    *datastore.Key `datastore:"-"`
+	Name      string
+	Tags      []string
+	Friend    *datastore.Key
+	CreatedAt time.Time
+	Location  datastore.GeoPoint
+}
+
+func tempPath(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gonmfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "gonm.db"), func() { os.RemoveAll(dir) }
+}
+
+func open(t *testing.T, path string) (*gonm.Gonm, *Backend) {
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Gonm(context.Background()), b
+}
+
+func TestBackend_Reopen(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	gm, b := open(t, path)
+	src := []*user{
+		{Name: "Michael", Tags: []string{"a", "b"}, CreatedAt: time.Unix(100, 0).UTC(), Location: datastore.GeoPoint{Lat: 1, Lng: 2}},
+		{ID: 1, Name: "Tom", Friend: datastore.IDKey("user", 2, nil)},
+		{ID: 2, Name: "Hanako"},
+	}
+	if _, err := gm.PutMulti(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := gm.Delete(src[2]); err != nil {
+		t.Fatal(err)
+	}
+	_, err := gm.RunInTransaction(func(gm *gonm.Gonm) error {
+		_, err := gm.Put(&user{Name: "Taro"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.store.PutMulti(context.Background(), []*datastore.Key{datastore.IDKey("user", 3, nil)}, []*user{{}})
+	assert.Equal(ErrClosed, err, "write after close")
+
+	gm, b = open(t, path)
+	defer gm.Close()
+	assert.Equal(3, b.Len())
+
+	dst := []*user{{ID: src[0].ID}, {ID: 1}}
+	if err := gm.GetMulti(dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(src[0].Tags, dst[0].Tags)
+	assert.True(src[0].CreatedAt.Equal(dst[0].CreatedAt))
+	assert.Equal(src[0].Location, dst[0].Location)
+	assert.Equal(src[1], dst[1])
+	assert.Equal(datastore.ErrNoSuchEntity, gm.Get(&user{ID: 2}))
+
+	allocated, err := gm.AllocateID(&user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _, err := gm.Query(&user{}).GetKeysOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		assert.NotEqual(key.ID, allocated.ID, "allocated id is not used")
+	}
+}
+
+func TestBackend_Compact(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	gm, b := open(t, path)
+	for i := 0; i < 10; i++ {
+		if _, err := gm.Put(&user{ID: 1, Name: "Michael"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(after.Size() < before.Size(), "compact file")
+
+	if _, err := gm.Put(&user{ID: 2, Name: "Tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gm, b = open(t, path)
+	defer gm.Close()
+	assert.Equal(2, b.Len(), "write after compact")
+}
+
+func TestBackend_TornRecord(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	gm, _ := open(t, path)
+	if _, err := gm.Put(&user{ID: 1, Name: "Michael"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size := fileSize(t, path)
+
+	// crash while writing a record
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 1, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	gm, b := open(t, path)
+	assert.Equal(1, b.Len())
+	assert.Equal(size, fileSize(t, path), "remove torn record")
+	if _, err := gm.Put(&user{ID: 2, Name: "Tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, b = open(t, path)
+	defer b.Close()
+	assert.Equal(2, b.Len())
+}
+
+func TestOpen_InvalidFile(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(path, []byte("not gonm file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Open(path)
+	assert.Equal(t, ErrInvalidFile, err)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * Package gonmtest provides the backend of Gonm for testing code using Gonm without Google Cloud Datastore.
+ */
+
+package gonmtest
+
+import (
+	"context"
+
+	"github.com/komem3/gonm"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/komem3/gonm/internal/memstore"
+)
+
+var (
+	// ErrAlreadyExists is returned when inserting an entity that already exists.
+	ErrAlreadyExists = memstore.ErrAlreadyExists
+	// ErrTransactionExpired is returned when using a committed or rolled back transaction.
+	ErrTransactionExpired = memstore.ErrTransactionExpired
+	// ErrReadOnlyTransaction is returned when writing in a read-only transaction.
+	ErrReadOnlyTransaction = memstore.ErrReadOnlyTransaction
+)
+
+// Memory is the backend of Gonm which stores entities on memory.
+//
+// Memory supports entity storage, ID allocation, queries with ancestors, filters, orders, limits and cursors,
+// and optimistic transactions which fail with datastore.ErrConcurrentTransaction on conflict.
+// Queries built by datastore.NewQuery are also supported, except for OR, IN, != and distinct queries,
+// which return gonm.ErrUnsupported.
+type Memory struct {
+	store *memstore.Store
+}
+
+// NewMemory generate empty Memory.
+func NewMemory() *Memory {
+	return &Memory{store: memstore.New(memstore.Options{})}
+}
+
+// Len returns the number of entities in m.
+func (m *Memory) Len() int {
+	return m.store.Len()
+}
+
+// Gonm generate Gonm running on m.
+func (m *Memory) Gonm(ctx context.Context) *gonm.Gonm {
+	return backend.NewGonm(ctx, m.store).(*gonm.Gonm)
+}
+
+// NewGonm generate Gonm running on a new Memory.
+func NewGonm(ctx context.Context) (*gonm.Gonm, *Memory) {
+	m := NewMemory()
+	return m.Gonm(ctx), m
+}
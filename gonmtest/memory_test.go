@@ -0,0 +1,745 @@
+package gonmtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+)
+
+type user struct {
+	ID     int64          `datastore:"-"`
+	Parent *datastore.Key `datastore:"-"`
+	Name   string
+	Age    int
+	Tags   []string
+}
+
+func TestMemory_PutGet(t *testing.T) {
+	assert := assert.New(t)
+	gm, mem := NewGonm(context.Background())
+
+	src := []*user{{Name: "Michael", Age: 20}, {ID: 1, Name: "Tom", Age: 30}}
+	keys, err := gm.PutMulti(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(keys[0].Incomplete(), "allocate id")
+	assert.NotZero(src[0].ID, "set allocated id")
+	assert.Equal(int64(1), keys[1].ID)
+	assert.Equal(2, mem.Len())
+
+	gm.CacheClear()
+	dst := []*user{{ID: src[0].ID}, {ID: 1}, {ID: 2}}
+	found, err := gm.GetMultiPartial(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]bool{true, true, false}, found)
+	assert.Equal(src[0], dst[0])
+	assert.Equal(src[1], dst[1])
+
+	if err := gm.Delete(src[1]); err != nil {
+		t.Fatal(err)
+	}
+	err = gm.GetConsistency(&user{ID: 1})
+	assert.Equal(datastore.ErrNoSuchEntity, err)
+
+	allocated, err := gm.AllocateID(&user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(src[0].ID, allocated.ID, "allocated id is unique")
+}
+
+func TestMemory_Query(t *testing.T) {
+	assert := assert.New(t)
+	gm, _ := NewGonm(context.Background())
+
+	parent := datastore.NameKey("group", "a", nil)
+	src := []*user{
+		{ID: 1, Parent: parent, Name: "Michael", Age: 20, Tags: []string{"x"}},
+		{ID: 2, Parent: parent, Name: "Tom", Age: 30, Tags: []string{"x", "y"}},
+		{ID: 3, Parent: parent, Name: "Hanako", Age: 40},
+		{ID: 4, Name: "Taro", Age: 50, Tags: []string{"y"}},
+	}
+	if _, err := gm.PutMulti(src); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query *gonm.Query
+		want  []int64
+	}{
+		{"all", gm.Query(&user{}), []int64{1, 2, 3, 4}},
+		{"ancestor", gm.Query(&user{}).AncestorKey(parent), []int64{1, 2, 3}},
+		{"filter", gm.Query(&user{}).Filter("Age >=", 30), []int64{2, 3, 4}},
+		{"multi-valued filter", gm.Query(&user{}).Filter("Tags =", "y"), []int64{2, 4}},
+		{"order", gm.Query(&user{}).Order("-Age"), []int64{4, 3, 2, 1}},
+		{"limit offset", gm.Query(&user{}).Order("Age").Offset(1).Limit(2), []int64{2, 3}},
+		{"key filter", gm.Query(&user{}).Filter("__key__ >", datastore.IDKey("user", 2, parent)), []int64{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst []*user
+			keys, err := tt.query.GetAll(&dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int64, len(dst))
+			for i, d := range dst {
+				assert.Equal(keys[i].ID, d.ID, "set struct key")
+				ids[i] = d.ID
+			}
+			assert.Equal(tt.want, ids)
+		})
+	}
+
+	t.Run("run", func(t *testing.T) {
+		it, err := gm.Query(&user{}).AncestorKey(parent).Order("-Age").Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for {
+			var dst user
+			_, err := it.Next(&dst)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(parent, dst.Parent, "set struct key")
+			ids = append(ids, dst.ID)
+		}
+		assert.Equal([]int64{3, 2, 1}, ids)
+	})
+
+	t.Run("get all cached", func(t *testing.T) {
+		var dst []user
+		keys, _, err := gm.GetAllCached(gm.Query(&user{}).Filter("Age <", 40), &dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(keys, 2)
+		assert.Equal(*src[0], dst[0])
+		assert.Equal(*src[1], dst[1])
+	})
+
+	t.Run("cursor", func(t *testing.T) {
+		q := gm.Query(&user{}).Order("Age").Limit(2)
+		keys, cursor, err := q.GetKeysOnly()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(keys, 2)
+		keys, _, err = q.Start(cursor).GetKeysOnly()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal([]int64{3, 4}, []int64{keys[0].ID, keys[1].ID})
+	})
+
+	t.Run("datastore query", func(t *testing.T) {
+		var dst []*user
+		q := datastore.NewQuery("user").Ancestor(parent).Filter("Age >", 20).Order("-Age")
+		keys, err := gm.GetAll(q, &dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(keys, 2)
+		assert.Equal([]int64{3, 2}, []int64{dst[0].ID, dst[1].ID})
+		assert.Equal(parent, dst[0].Parent, "set struct key")
+
+		keys, cursor, err := gm.GetKeysOnly(datastore.NewQuery("user").Filter("__key__ >", datastore.IDKey("user", 1, parent)).Limit(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal([]int64{2, 3}, []int64{keys[0].ID, keys[1].ID})
+		keys, _, err = gm.GetKeysOnly(datastore.NewQuery("user").Filter("__key__ >", datastore.IDKey("user", 1, parent)).Start(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal([]int64{4}, []int64{keys[0].ID})
+
+		it, err := gm.Run(datastore.NewQuery("user").Filter("Tags =", "y").Filter("Name =", "Taro"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got user
+		if _, err := it.Next(&got); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(*src[3], got)
+		_, err = it.Next(&got)
+		assert.Equal(iterator.Done, err)
+
+		keys, err = gm.GetAll(datastore.NewQuery("user").Limit(0), &dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(keys)
+
+		_, err = gm.GetAll(datastore.NewQuery("user").FilterField("Age", "!=", 20), &[]*user{})
+		assert.Equal(gonm.ErrUnsupported, err, "!= filter")
+	})
+}
+
+func TestMemory_CursorAfterDelete(t *testing.T) {
+	assert := assert.New(t)
+	gm, _ := NewGonm(context.Background())
+
+	src := []*user{{ID: 1}, {ID: 2}, {ID: 3}}
+	if _, err := gm.PutMulti(src); err != nil {
+		t.Fatal(err)
+	}
+	q := gm.Query(&user{}).Limit(2)
+	_, cursor, err := q.GetKeysOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gm.DeleteMulti(src[:2]); err != nil {
+		t.Fatal(err)
+	}
+	keys, _, err := q.Start(cursor).GetKeysOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(keys, 1)
+	assert.Equal(int64(3), keys[0].ID, "cursor is after the deleted entity")
+}
+
+func TestMemory_Mutate(t *testing.T) {
+	assert := assert.New(t)
+	gm, _ := NewGonm(context.Background())
+
+	if _, err := gm.Mutate(gonm.NewInsert(&user{ID: 1, Name: "Michael"})); err != nil {
+		t.Fatal(err)
+	}
+	_, err := gm.Mutate(gonm.NewInsert(&user{ID: 1, Name: "Tom"}))
+	assert.Equal(ErrAlreadyExists, err, "insert existing entity")
+	_, err = gm.Mutate(gonm.NewUpdate(&user{ID: 2, Name: "Tom"}))
+	assert.Equal(datastore.ErrNoSuchEntity, err, "update missing entity")
+
+	dst := &user{ID: 1}
+	if err := gm.GetConsistency(dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("Michael", dst.Name, "failed mutations are not applied")
+}
+
+func TestMemory_RunInTransaction(t *testing.T) {
+	assert := assert.New(t)
+	gm, _ := NewGonm(context.Background())
+
+	if _, err := gm.Put(&user{ID: 1, Name: "Michael", Age: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("pending key", func(t *testing.T) {
+		src := &user{Name: "Tom"}
+		cmt, err := gm.RunInTransaction(func(gm *gonm.Gonm) error {
+			_, err := gm.Put(src)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(cmt, "datastore.Commit is only of Google Cloud Datastore")
+		assert.NotZero(src.ID, "resolve pending key")
+
+		tx, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		src = &user{Name: "Bob"}
+		pkey, err := tx.Put(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(pkey, "datastore.PendingKey is only of Google Cloud Datastore")
+		if _, err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotZero(src.ID, "resolve pending key")
+	})
+
+	t.Run("retry conflict", func(t *testing.T) {
+		var attempts int
+		_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			attempts++
+			dst := &user{ID: 1}
+			if err := tx.Get(dst); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// concurrent write
+				if _, err := gm.Put(&user{ID: 1, Name: "Michael", Age: dst.Age + 10}); err != nil {
+					return err
+				}
+			}
+			dst.Age++
+			_, err := tx.Put(dst)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(2, attempts, "retry after conflict")
+
+		dst := &user{ID: 1}
+		if err := gm.GetConsistency(dst); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(31, dst.Age, "apply both writes")
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		var attempts int
+		_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			attempts++
+			dst := &user{ID: 1}
+			if err := tx.Get(dst); err != nil {
+				return err
+			}
+			// concurrent write
+			if _, err := gm.Put(&user{ID: 1, Name: "Michael", Age: dst.Age}); err != nil {
+				return err
+			}
+			_, err := tx.Put(dst)
+			return err
+		}, gonm.MaxAttempts(1))
+		assert.Equal(datastore.ErrConcurrentTransaction, err)
+		assert.Equal(1, attempts, "no retry")
+	})
+
+	t.Run("retry policy", func(t *testing.T) {
+		gm := gm.WithContext(context.Background())
+		var attempts int
+		gm.RetryPolicy = &gonm.RetryPolicy{
+			MaxAttempts: 5,
+			OnAttempt:   func(attempt int, err error) { attempts = attempt },
+		}
+
+		var srcs []*user
+		_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			dst := &user{ID: 1}
+			if err := tx.Get(dst); err != nil {
+				return err
+			}
+			src := &user{Name: "Jack"}
+			srcs = append(srcs, src)
+			if _, err := tx.PutMulti([]*user{dst, src}); err != nil {
+				return err
+			}
+			if len(srcs) < 3 {
+				// concurrent write
+				if _, err := gm.Put(&user{ID: 1, Name: "Michael", Age: dst.Age}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(3, attempts, "retry after conflicts")
+		assert.Zero(srcs[0].ID, "discard pending of failed attempt")
+		assert.Zero(srcs[1].ID, "discard pending of failed attempt")
+		assert.NotZero(srcs[2].ID, "resolve pending key")
+	})
+
+	t.Run("hooks", func(t *testing.T) {
+		var (
+			attempts  int
+			committed []int
+			rollbacks []error
+		)
+		src := &user{Name: "Jack"}
+		_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			attempts++
+			attempt := attempts
+			tx.OnCommit(func(*datastore.Commit) {
+				assert.NotZero(src.ID, "run after resolving pending keys")
+				committed = append(committed, attempt)
+			})
+			tx.OnRollback(func(err error) {
+				rollbacks = append(rollbacks, err)
+			})
+			dst := &user{ID: 1}
+			if err := tx.Get(dst); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// concurrent write
+				if _, err := gm.Put(&user{ID: 1, Name: "Michael", Age: dst.Age}); err != nil {
+					return err
+				}
+			}
+			_, err := tx.PutMulti([]*user{dst, src})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal([]int{2}, committed, "only committed attempt")
+		assert.Empty(rollbacks, "failed attempt")
+
+		tx, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.OnRollback(func(err error) {
+			rollbacks = append(rollbacks, err)
+		})
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal([]error{nil}, rollbacks)
+	})
+
+	t.Run("transaction methods", func(t *testing.T) {
+		parent := datastore.NameKey("group", "methods", nil)
+		if _, err := gm.PutMulti([]*user{{ID: 1, Parent: parent, Age: 10}, {ID: 2, Parent: parent, Age: 20}}); err != nil {
+			t.Fatal(err)
+		}
+		tx, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		var dst user
+		if err := tx.GetByKey(datastore.IDKey("user", 2, parent), &dst); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(20, dst.Age)
+
+		q := tx.Query(&user{}).AncestorKey(parent)
+		sum, err := tx.Sum(q, "Age")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(float64(30), sum)
+
+		var users []*user
+		if _, err := tx.Query(&user{}).AncestorKey(parent).Filter("Age >", 10).GetAll(&users); err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(users, 1)
+
+		_, err = tx.Count(tx.Query(&user{}))
+		assert.Equal(gonm.ErrNoAncestor, err)
+		_, err = tx.GetAll(datastore.NewQuery("user"), &[]*user{})
+		assert.Equal(gonm.ErrNoAncestor, err, "datastore query")
+		assert.Equal(gm.Errors, tx.Errors)
+
+		if _, err := tx.Put(&user{ID: 3, Parent: parent}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		setAge := func(gm *gonm.Gonm, age int) error {
+			_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+				dst := &user{ID: 1}
+				if err := tx.Get(dst); err != nil {
+					return err
+				}
+				dst.Age = age
+				_, err := tx.Put(dst)
+				return err
+			})
+			return err
+		}
+
+		_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			return setAge(tx, 1)
+		})
+		assert.Equal(gonm.ErrNestedTransaction, err)
+
+		gm := gm.WithContext(context.Background())
+		gm.JoinTransaction = true
+		if err := setAge(gm, 50); err != nil {
+			t.Fatal(err)
+		}
+		errFailed := errors.New("failed")
+		_, err = gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			if err := setAge(tx, 60); err != nil {
+				return err
+			}
+			_, _ = tx.RunInTransaction(func(*gonm.Gonm) error { return errFailed })
+			return nil
+		})
+		assert.Equal(errFailed, err, "roll back on error of joined function")
+
+		dst := &user{ID: 1}
+		if err := gm.GetConsistency(dst); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(50, dst.Age)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		tx1, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx2, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tx := range []*gonm.Transaction{tx1, tx2} {
+			dst := &user{ID: 1}
+			if err := tx.Get(dst); err != nil {
+				t.Fatal(err)
+			}
+			dst.Age++
+			if _, err := tx.Mutate(gonm.NewUpsert(dst)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := tx1.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx2.Commit()
+		assert.Equal(datastore.ErrConcurrentTransaction, err)
+	})
+
+	t.Run("ancestor query", func(t *testing.T) {
+		parent := datastore.NameKey("group", "tx", nil)
+		if _, err := gm.PutMulti([]*user{{ID: 1, Parent: parent}, {ID: 2, Parent: parent}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var attempts int
+		_, err := gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			attempts++
+			keys, _, err := tx.Query(&user{}).AncestorKey(parent).GetKeysOnly()
+			if err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// concurrent insert into the entity group
+				if _, err := gm.Put(&user{ID: 3, Parent: parent}); err != nil {
+					return err
+				}
+			}
+			_, err = tx.Put(&user{ID: 100, Parent: parent, Age: len(keys)})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(2, attempts, "retry after insert into the entity group")
+
+		dst := &user{ID: 100, Parent: parent}
+		if err := gm.GetConsistency(dst); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(3, dst.Age)
+
+		_, err = gm.RunInTransaction(func(tx *gonm.Gonm) error {
+			_, err := tx.Query(&user{}).Run()
+			return err
+		})
+		assert.Equal(gonm.ErrNoAncestor, err)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		_, err := gm.RunInTransaction(func(gm *gonm.Gonm) error {
+			_, err := gm.Put(&user{ID: 1})
+			return err
+		}, datastore.ReadOnly)
+		assert.Equal(gonm.ErrReadOnly, err)
+
+		err = gm.RunInReadOnlyTransaction(func(tx *gonm.Gonm) error {
+			dst := []*user{{ID: 1}}
+			if err := tx.GetMulti(dst); err != nil {
+				return err
+			}
+			assert.Equal("Michael", dst[0].Name)
+			return tx.Delete(dst[0])
+		})
+		assert.Equal(gonm.ErrReadOnly, err)
+
+		tx, err := gm.NewTransaction(datastore.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx.Put(&user{ID: 1})
+		assert.Equal(gonm.ErrReadOnly, err)
+
+		err = gm.ReadAt(time.Now()).Get(&user{ID: 1})
+		assert.Equal(gonm.ErrUnsupported, err, "Memory keeps no history")
+	})
+}
+
+func TestMemory_Concurrent(t *testing.T) {
+	gm, mem := NewGonm(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := gm.Put(&user{Name: "Michael"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 10, mem.Len())
+}
+
+func TestMemory_Version(t *testing.T) {
+	assert := assert.New(t)
+	gm, _ := NewGonm(context.Background())
+
+	type document struct {
+		ID      int64 `datastore:"-"`
+		Title   string
+		Version int64 `gonm:"version"`
+	}
+
+	doc := &document{Title: "draft"}
+	if _, err := gm.Put(doc); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotZero(doc.ID)
+	assert.Equal(int64(1), doc.Version, "increment out of transaction")
+
+	// two edit forms read the same version
+	form1, form2 := *doc, *doc
+	form1.Title = "first"
+	if _, err := gm.Put(&form1); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(int64(2), form1.Version)
+
+	form2.Title = "second"
+	_, err := gm.Put(&form2)
+	assert.True(errors.Is(err, gonm.ErrVersionConflict), "lost update")
+	assert.Equal(&gonm.VersionConflictError{Key: datastore.IDKey("document", doc.ID, nil), Expected: 1, Actual: 2}, err)
+	assert.Equal(int64(1), form2.Version, "keep version on conflict")
+
+	_, err = gm.RunInTransaction(func(tx *gonm.Gonm) error {
+		form1.Title = "third"
+		_, err := tx.Mutate(gonm.NewUpdate(&form1))
+		assert.Equal(int64(2), form1.Version, "increment on commit")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(int64(3), form1.Version)
+
+	_, err = gm.Mutate(gonm.NewUpdate(&form2))
+	assert.True(errors.Is(err, gonm.ErrVersionConflict))
+
+	_, err = gm.RunInTransaction(func(tx *gonm.Gonm) error {
+		if _, err := tx.Put(&form1); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	assert.Error(err)
+	assert.Equal(int64(3), form1.Version, "keep version on rollback")
+
+	stored := &document{ID: doc.ID}
+	if err := gm.GetConsistency(stored); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(document{ID: doc.ID, Title: "third", Version: 3}, *stored)
+
+	form1.Title = "fourth"
+	mut := gonm.NewUpdate(&form1)
+	form1.Title = "changed after NewUpdate"
+	if _, err := gm.Mutate(mut); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(int64(4), form1.Version)
+	if err := gm.GetConsistency(stored); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(document{ID: doc.ID, Title: "fourth", Version: 4}, *stored, "save the entity of NewUpdate with incremented version")
+
+	_, err = gm.Put(&document{ID: doc.ID + 1, Version: 5})
+	assert.Equal(&gonm.VersionConflictError{Key: datastore.IDKey("document", doc.ID+1, nil), Expected: 5}, err, "not stored")
+}
+
+func TestMemory_Paginate(t *testing.T) {
+	assert := assert.New(t)
+	gm, _ := NewGonm(context.Background())
+	gm.PageTokenKey = []byte("secret")
+
+	src := []*user{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}
+	if _, err := gm.PutMulti(src); err != nil {
+		t.Fatal(err)
+	}
+	q := gm.Query(&user{}).Order("__key__")
+	ids := func(page *gonm.Page) []int64 {
+		var ret []int64
+		for _, key := range page.Keys {
+			ret = append(ret, key.ID)
+		}
+		return ret
+	}
+
+	first, err := gm.Paginate(q, 2, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := gm.Paginate(q, 2, first.NextToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := gm.Paginate(q, 2, second.NextToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]int64{1, 2}, ids(first))
+	assert.Equal([]int64{3, 4}, ids(second))
+	assert.Equal([]int64{5}, ids(third))
+	assert.False(third.HasMore)
+
+	prev, err := gm.Paginate(q, 2, third.PrevToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]int64{3, 4}, ids(prev), "previous page")
+	assert.Empty(prev.PrevToken, "token keeps only the previous page")
+	assert.Equal(second.NextToken, prev.NextToken)
+
+	prev, err = gm.Paginate(q, 2, second.PrevToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]int64{1, 2}, ids(prev), "first page")
+
+	_, cursor, err := q.Limit(1).GetKeysOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, q := range map[string]*gonm.Query{
+		"limit":  q.Limit(3),
+		"offset": q.Offset(1),
+		"start":  q.Start(cursor),
+		"end":    q.End(cursor),
+	} {
+		_, err := gm.Paginate(q, 2, "", nil)
+		var qerr *gonm.QueryError
+		assert.True(errors.As(err, &qerr), name)
+	}
+
+	_, err = gm.Paginate(q, 0, "", nil)
+	assert.Equal(gonm.ErrInvalidPageSize, err)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * Package backend defines the storage on which Gonm runs.
+ */
+
+package backend
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// NewGonm generates *gonm.Gonm running on b.
+// Package gonm sets NewGonm, so that the packages providing Backend generate Gonm
+// without the constructor of package gonm which takes Backend.
+var NewGonm func(ctx context.Context, b Backend) interface{}
+
+// Backend is the storage on which Gonm runs.
+//
+// Gonm generates keys from structures and manages cache, and Backend stores the entities.
+// Dst and src of the methods are slices of the same length as keys, such as []*S, []S or []interface{}.
+// Like datastore.Client, Backend returns datastore.MultiError for per-key errors
+// and datastore.ErrNoSuchEntity for missing entities.
+type Backend interface {
+	// AllocateIDs returns complete keys of incomplete keys.
+	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
+	// GetMulti loads the entities of keys into dst.
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	// GetMultiAt loads the entities of keys as they were at readTime into dst.
+	// The backends which keep no history return ErrUnsupported.
+	GetMultiAt(ctx context.Context, readTime time.Time, keys []*datastore.Key, dst interface{}) error
+	// PutMulti saves src with keys and returns the complete keys.
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	// DeleteMulti deletes the entities of keys.
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	// Mutate applies muts atomically and returns the complete keys.
+	Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Key, error)
+	// Run runs q.
+	Run(ctx context.Context, q *Query) Iterator
+	// GetAll runs q and appends the entities to dst.
+	GetAll(ctx context.Context, q *Query, dst interface{}) ([]*datastore.Key, error)
+	// NewTransaction starts a new transaction.
+	NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (Transaction, error)
+	// RunInTransaction runs f in a transaction and commits it.
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (Commit, error)
+	// Close closes the Backend.
+	Close() error
+}
+
+// Transaction is a transaction of Backend.
+type Transaction interface {
+	// GetMulti loads the entities of keys into dst.
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+	// PutMulti enqueues saving src with keys.
+	PutMulti(keys []*datastore.Key, src interface{}) ([]PendingKey, error)
+	// DeleteMulti enqueues deleting the entities of keys.
+	DeleteMulti(keys []*datastore.Key) error
+	// Mutate enqueues muts.
+	Mutate(muts ...*Mutation) ([]PendingKey, error)
+	// Run runs the ancestor query q in the transaction.
+	Run(q *Query) Iterator
+	// GetAll runs the ancestor query q in the transaction and appends the entities to dst.
+	GetAll(q *Query, dst interface{}) ([]*datastore.Key, error)
+	// Commit applies the enqueued operations atomically.
+	Commit() (Commit, error)
+	// Rollback abandons the transaction.
+	Rollback() error
+}
+
+// Iterator is the result of running a query.
+type Iterator interface {
+	// Next returns the key of the next result and loads it into dst.
+	// When there are no more results, Next returns iterator.Done.
+	Next(dst interface{}) (*datastore.Key, error)
+	// Cursor returns a cursor for the iterator's current location.
+	Cursor() (datastore.Cursor, error)
+}
+
+// PendingKey represents the key of an entity put in a transaction.
+// Commit resolves PendingKey to the complete key.
+//
+// PendingKey of Datastore is *datastore.PendingKey.
+type PendingKey interface{}
+
+// Commit represents the result of a committed transaction.
+type Commit interface {
+	// Key resolves p to the complete key.
+	Key(p PendingKey) *datastore.Key
+}
+
+// MutationOp is the operation of Mutation.
+type MutationOp int
+
+const (
+	// MutationInsert saves an entity which must not exist.
+	MutationInsert MutationOp = iota + 1
+	// MutationUpdate saves an entity which must exist.
+	MutationUpdate
+	// MutationUpsert saves an entity whether or not it exists.
+	MutationUpsert
+	// MutationDelete deletes an entity.
+	MutationDelete
+)
+
+// Mutation is an operation of Mutate.
+type Mutation struct {
+	Op  MutationOp
+	Key *datastore.Key
+	// Properties is the entity to save, which was saved when the mutation was built.
+	// Properties is not used by MutationDelete.
+	Properties []datastore.Property
+	// Datastore is the mutation of Src for datastore.
+	Datastore *datastore.Mutation
+}
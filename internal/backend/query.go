@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for query run on Backend
+ */
+
+package backend
+
+import (
+	"errors"
+
+	"cloud.google.com/go/datastore"
+)
+
+var (
+	// ErrUnsupported is returned when Backend cannot serve the request.
+	ErrUnsupported = errors.New("gonm: the backend does not support this method")
+	// ErrNoAncestor is returned when a query in transaction is not an ancestor query.
+	ErrNoAncestor = errors.New("gonm: query in transaction must be an ancestor query")
+)
+
+// Query is a query run on Backend.
+type Query struct {
+	// Datastore is the query for Google Cloud Datastore.
+	Datastore *datastore.Query
+	// Description is the content of the query recorded by the query builder of Gonm.
+	// Description is nil when the query was built by datastore.NewQuery, whose content is not exposed.
+	// The backends other than Google Cloud Datastore read it from Datastore then.
+	Description *QueryDescription
+}
+
+// QueryDescription is the content of Query, which the backends other than Google Cloud Datastore evaluate.
+type QueryDescription struct {
+	Kind       string
+	Namespace  string
+	Ancestor   *datastore.Key
+	Filters    []QueryFilter
+	Orders     []QueryOrder
+	Projection []string
+	KeysOnly   bool
+	// Limit is -1 when the query has no limit.
+	Limit  int32
+	Offset int32
+	// Start and End are the start and end cursors. The zero Cursor means no cursor.
+	Start datastore.Cursor
+	End   datastore.Cursor
+}
+
+// QueryFilter is a filter of query.
+type QueryFilter struct {
+	// Property is the name of the property. The key of entity is "__key__".
+	Property string
+	// Op is one of "<", "<=", "=", ">=" and ">".
+	Op    string
+	Value interface{}
+}
+
+// QueryOrder is a sort order of query.
+type QueryOrder struct {
+	// Property is the name of the property. The key of entity is "__key__".
+	Property   string
+	Descending bool
+}
+
+// Clone returns a copy of d which shares no slices with d.
+func (d *QueryDescription) Clone() *QueryDescription {
+	ret := *d
+	ret.Filters = append([]QueryFilter(nil), d.Filters...)
+	ret.Orders = append([]QueryOrder(nil), d.Orders...)
+	ret.Projection = append([]string(nil), d.Projection...)
+	return &ret
+}
+
+// KeysOnly returns a keys-only query of q.
+func (q *Query) KeysOnly() *Query {
+	ret := &Query{Datastore: q.Datastore.KeysOnly()}
+	if q.Description != nil {
+		ret.Description = q.Description.Clone()
+		ret.Description.KeysOnly = true
+	}
+	return ret
+}
+
+// MaxAttempts is the transaction option of the number of attempts of RunInTransaction.
+// MaxAttempts embeds datastore.MaxAttempts, so Google Cloud Datastore also honors it.
+type MaxAttempts struct {
+	datastore.TransactionOption
+	Attempts int
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * Package keyorder compares keys in the order of datastore.
+ */
+
+package keyorder
+
+import (
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Compare compares keys in the order of datastore, that is, by path from the root.
+// Compare returns -1 if a is before b, 1 if a is after b, and 0 if they are equal.
+func Compare(a, b *datastore.Key) int {
+	pa, pb := path(a), path(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := compareElem(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(int64(len(pa)), int64(len(pb)))
+}
+
+func compareElem(a, b *datastore.Key) int {
+	if c := strings.Compare(a.Namespace, b.Namespace); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Kind, b.Kind); c != 0 {
+		return c
+	}
+	// ID keys are before name keys
+	switch {
+	case a.Name == "" && b.Name != "":
+		return -1
+	case a.Name != "" && b.Name == "":
+		return 1
+	case a.Name != "":
+		return strings.Compare(a.Name, b.Name)
+	}
+	return compareInt(a.ID, b.ID)
+}
+
+func path(key *datastore.Key) []*datastore.Key {
+	var ret []*datastore.Key
+	for k := key; k != nil; k = k.Parent {
+		ret = append([]*datastore.Key{k}, ret...)
+	}
+	return ret
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for reading the content of datastore.Query.
+ */
+
+package memstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// The content of datastore.Query is not exported, but datastore.Client encodes it into RunQueryRequest.
+// describe runs the query on a client whose connection stops the request before sending it,
+// and reads the description from the request.
+var (
+	describeOnce   sync.Once
+	describeClient *datastore.Client
+	describeErr    error
+)
+
+// filterOps is the operators of PropertyFilter which QueryDescription supports.
+var filterOps = map[pb.PropertyFilter_Operator]string{
+	pb.PropertyFilter_LESS_THAN:             "<",
+	pb.PropertyFilter_LESS_THAN_OR_EQUAL:    "<=",
+	pb.PropertyFilter_EQUAL:                 "=",
+	pb.PropertyFilter_GREATER_THAN_OR_EQUAL: ">=",
+	pb.PropertyFilter_GREATER_THAN:          ">",
+}
+
+// capturedQuery is the error which stops RunQueryRequest and carries it.
+// It is not a gRPC status, so datastore.Client does not retry it.
+type capturedQuery struct {
+	req *pb.RunQueryRequest
+}
+
+func (c *capturedQuery) Error() string {
+	return "memstore: captured query"
+}
+
+func captureQuery(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if r, ok := req.(*pb.RunQueryRequest); ok {
+		return &capturedQuery{req: r}
+	}
+	return backend.ErrUnsupported
+}
+
+func queryClient() (*datastore.Client, error) {
+	describeOnce.Do(func() {
+		conn, err := grpc.Dial("passthrough:///memstore",
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithUnaryInterceptor(captureQuery))
+		if err != nil {
+			describeErr = err
+			return
+		}
+		describeClient, describeErr = datastore.NewClient(context.Background(), "memstore", option.WithGRPCConn(conn))
+	})
+	return describeClient, describeErr
+}
+
+// describe returns the description of q.
+// The description of the query built by datastore.NewQuery is read from its RunQueryRequest,
+// and the queries which QueryDescription cannot express return backend.ErrUnsupported.
+func describe(ctx context.Context, q *backend.Query) (*backend.QueryDescription, error) {
+	if q.Description != nil {
+		return q.Description, nil
+	}
+	if q.Datastore == nil {
+		return nil, backend.ErrUnsupported
+	}
+	client, err := queryClient()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.Run(ctx, q.Datastore).Next(nil)
+	var captured *capturedQuery
+	switch {
+	case errors.As(err, &captured):
+		return describeRequest(captured.req)
+	case err == iterator.Done:
+		// datastore.Client returns no results without the request when the limit is 0.
+		return &backend.QueryDescription{Limit: 0}, nil
+	case err == nil:
+		return nil, backend.ErrUnsupported
+	}
+	return nil, err
+}
+
+func describeRequest(req *pb.RunQueryRequest) (*backend.QueryDescription, error) {
+	q := req.GetQuery()
+	if q == nil || len(q.Kind) > 1 || len(q.DistinctOn) > 0 {
+		return nil, backend.ErrUnsupported
+	}
+	info := &backend.QueryDescription{
+		Namespace: req.GetPartitionId().GetNamespaceId(),
+		Limit:     -1,
+		Offset:    q.Offset,
+	}
+	if len(q.Kind) == 1 {
+		info.Kind = q.Kind[0].Name
+	}
+	for _, p := range q.Projection {
+		if name := p.GetProperty().GetName(); name == keyFieldName {
+			info.KeysOnly = true
+		} else {
+			info.Projection = append(info.Projection, name)
+		}
+	}
+	for _, o := range q.Order {
+		info.Orders = append(info.Orders, backend.QueryOrder{
+			Property:   o.GetProperty().GetName(),
+			Descending: o.Direction == pb.PropertyOrder_DESCENDING,
+		})
+	}
+	if err := describeFilter(info, q.Filter); err != nil {
+		return nil, err
+	}
+	if q.Limit != nil {
+		info.Limit = q.Limit.Value
+	}
+
+	var err error
+	if len(q.StartCursor) > 0 {
+		if info.Start, err = datastore.DecodeCursor(base64.URLEncoding.EncodeToString(q.StartCursor)); err != nil {
+			return nil, err
+		}
+	}
+	if len(q.EndCursor) > 0 {
+		if info.End, err = datastore.DecodeCursor(base64.URLEncoding.EncodeToString(q.EndCursor)); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// describeFilter adds f to info. Only AND of comparisons and the ancestor are supported.
+func describeFilter(info *backend.QueryDescription, f *pb.Filter) error {
+	switch f := f.GetFilterType().(type) {
+	case nil:
+		return nil
+	case *pb.Filter_CompositeFilter:
+		if f.CompositeFilter.Op != pb.CompositeFilter_AND {
+			return backend.ErrUnsupported
+		}
+		for _, sub := range f.CompositeFilter.Filters {
+			if err := describeFilter(info, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *pb.Filter_PropertyFilter:
+		pf := f.PropertyFilter
+		v, err := valueOf(pf.Value)
+		if err != nil {
+			return err
+		}
+		if pf.Op == pb.PropertyFilter_HAS_ANCESTOR {
+			key, ok := v.(*datastore.Key)
+			if !ok {
+				return backend.ErrUnsupported
+			}
+			info.Ancestor = key
+			return nil
+		}
+		op, ok := filterOps[pf.Op]
+		if !ok {
+			return backend.ErrUnsupported
+		}
+		info.Filters = append(info.Filters, backend.QueryFilter{Property: pf.GetProperty().GetName(), Op: op, Value: v})
+		return nil
+	}
+	return backend.ErrUnsupported
+}
+
+// valueOf returns the Go value of v, which is the value datastore.SaveStruct stores.
+func valueOf(v *pb.Value) (interface{}, error) {
+	switch v := v.GetValueType().(type) {
+	case *pb.Value_NullValue:
+		return nil, nil
+	case *pb.Value_BooleanValue:
+		return v.BooleanValue, nil
+	case *pb.Value_IntegerValue:
+		return v.IntegerValue, nil
+	case *pb.Value_DoubleValue:
+		return v.DoubleValue, nil
+	case *pb.Value_TimestampValue:
+		return v.TimestampValue.AsTime(), nil
+	case *pb.Value_KeyValue:
+		return keyOf(v.KeyValue), nil
+	case *pb.Value_StringValue:
+		return v.StringValue, nil
+	case *pb.Value_BlobValue:
+		return v.BlobValue, nil
+	case *pb.Value_GeoPointValue:
+		return datastore.GeoPoint{Lat: v.GeoPointValue.GetLatitude(), Lng: v.GeoPointValue.GetLongitude()}, nil
+	}
+	return nil, backend.ErrUnsupported
+}
+
+func keyOf(k *pb.Key) *datastore.Key {
+	var key *datastore.Key
+	for _, e := range k.Path {
+		switch id := e.IdType.(type) {
+		case *pb.Key_PathElement_Id:
+			key = datastore.IDKey(e.Kind, id.Id, key)
+		case *pb.Key_PathElement_Name:
+			key = datastore.NameKey(e.Kind, id.Name, key)
+		default:
+			key = datastore.IncompleteKey(e.Kind, key)
+		}
+		key.Namespace = k.GetPartitionId().GetNamespaceId()
+	}
+	return key
+}
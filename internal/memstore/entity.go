@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for converting between entities and Go values.
+ */
+
+package memstore
+
+import (
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/keyorder"
+)
+
+var typeOfPropertyLoadSaver = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
+
+// pointerOf returns the pointer to the entity held by v.
+// v is an element of slice passed to GetMulti or PutMulti, or dst passed to Next.
+func pointerOf(v reflect.Value) (reflect.Value, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch {
+	case !v.IsValid():
+		return reflect.Value{}, datastore.ErrInvalidEntityType
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			if !v.CanSet() {
+				return reflect.Value{}, datastore.ErrInvalidEntityType
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v, nil
+	case v.CanAddr():
+		return v.Addr(), nil
+	default:
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		return p, nil
+	}
+}
+
+// saveEntity returns the properties of the entity held by v.
+func saveEntity(v reflect.Value) ([]datastore.Property, error) {
+	p, err := pointerOf(v)
+	if err != nil {
+		return nil, err
+	}
+	if pls, ok := p.Interface().(datastore.PropertyLoadSaver); ok {
+		props, err := pls.Save()
+		if err != nil {
+			return nil, err
+		}
+		return cloneProperties(props), nil
+	}
+	if p.Elem().Kind() != reflect.Struct {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	return datastore.SaveStruct(p.Interface())
+}
+
+// loadEntity loads props of key into the entity held by v.
+func loadEntity(v reflect.Value, key *datastore.Key, props []datastore.Property) error {
+	p, err := pointerOf(v)
+	if err != nil {
+		return err
+	}
+	props = cloneProperties(props)
+	if kl, ok := p.Interface().(datastore.KeyLoader); ok {
+		if err := kl.LoadKey(key); err != nil {
+			return err
+		}
+	}
+	if pls, ok := p.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	if p.Elem().Kind() != reflect.Struct {
+		return datastore.ErrInvalidEntityType
+	}
+	return datastore.LoadStruct(p.Interface(), props)
+}
+
+// newElem returns a new element of slice whose element type is elemType, and the pointer to load into it.
+func newElem(elemType reflect.Type) (elem, ptr reflect.Value) {
+	if elemType.Kind() == reflect.Ptr && !elemType.Implements(typeOfPropertyLoadSaver) {
+		ptr = reflect.New(elemType.Elem())
+		return ptr, ptr
+	}
+	ptr = reflect.New(elemType)
+	return ptr.Elem(), ptr
+}
+
+func cloneProperties(props []datastore.Property) []datastore.Property {
+	if props == nil {
+		return nil
+	}
+	ret := make([]datastore.Property, len(props))
+	for i, prop := range props {
+		ret[i] = prop
+		ret[i].Value = cloneValue(prop.Value)
+	}
+	return ret
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return append([]byte(nil), v...)
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, e := range v {
+			ret[i] = cloneValue(e)
+		}
+		return ret
+	case *datastore.Entity:
+		if v == nil {
+			return v
+		}
+		return &datastore.Entity{Key: v.Key, Properties: cloneProperties(v.Properties)}
+	default:
+		return v
+	}
+}
+
+// normalize converts v to the type that datastore stores.
+func normalize(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.String:
+		return rv.String()
+	}
+	return v
+}
+
+// rank returns the order of the type of v in sort order of values.
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case time.Time:
+		return 2
+	case bool:
+		return 3
+	case []byte:
+		return 4
+	case string:
+		return 5
+	case datastore.GeoPoint:
+		return 6
+	case *datastore.Key:
+		return 7
+	default:
+		return 8
+	}
+}
+
+// compareValues compares normalized values a and b.
+// The second result is false if a and b are not comparable in filters.
+func compareValues(a, b interface{}) (int, bool) {
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return compareInt(int64(ra), int64(rb)), false
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0, true
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return compareInt(a, b), true
+		case float64:
+			return compareFloat(float64(a), b), true
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return compareFloat(a, float64(b)), true
+		case float64:
+			return compareFloat(a, b), true
+		}
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1, true
+		case a.After(b):
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		b := b.(bool)
+		switch {
+		case a == b:
+			return 0, true
+		case !a:
+			return -1, true
+		}
+		return 1, true
+	case []byte:
+		return compareString(string(a), string(b.([]byte))), true
+	case string:
+		return compareString(a, b.(string)), true
+	case datastore.GeoPoint:
+		b := b.(datastore.GeoPoint)
+		if c := compareFloat(a.Lat, b.Lat); c != 0 {
+			return c, true
+		}
+		return compareFloat(a.Lng, b.Lng), true
+	case *datastore.Key:
+		return keyorder.Compare(a, b.(*datastore.Key)), true
+	}
+	return 0, false
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
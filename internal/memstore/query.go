@@ -0,0 +1,413 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for query on memory.
+ */
+
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/komem3/gonm/internal/keyorder"
+	"google.golang.org/api/iterator"
+)
+
+const keyFieldName = "__key__"
+
+// cursorPrefix is the prefix of cursors of Store.
+var cursorPrefix = []byte("memstore:")
+
+// Run runs q.
+// Store evaluates the description of q. The description of the query built by datastore.NewQuery
+// is read from the query, and the filters other than comparisons return backend.ErrUnsupported.
+func (s *Store) Run(ctx context.Context, q *backend.Query) backend.Iterator {
+	info, err := describe(ctx, q)
+	if err != nil {
+		return &Iterator{ctx: ctx, err: err}
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	it, err := s.run(info)
+	if err != nil {
+		return &Iterator{ctx: ctx, err: err}
+	}
+	it.ctx = ctx
+	return it
+}
+
+// GetAll runs q and appends the entities to dst.
+func (s *Store) GetAll(ctx context.Context, q *backend.Query, dst interface{}) ([]*datastore.Key, error) {
+	info, err := describe(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return getAll(s.Run(ctx, &backend.Query{Description: info}), info, dst)
+}
+
+// getAll appends the results of it, which runs the query of info, to dst.
+func getAll(it backend.Iterator, info *backend.QueryDescription, dst interface{}) ([]*datastore.Key, error) {
+	var sv reflect.Value
+	if !info.KeysOnly {
+		v := reflect.ValueOf(dst)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+			return nil, datastore.ErrInvalidEntityType
+		}
+		sv = v.Elem()
+	}
+
+	var keys []*datastore.Key
+	var errFieldMismatch error
+	for {
+		var elem, ptr reflect.Value
+		var d interface{}
+		if sv.IsValid() {
+			elem, ptr = newElem(sv.Type().Elem())
+			d = ptr.Interface()
+		}
+		key, err := it.Next(d)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return keys, err
+			}
+			if errFieldMismatch == nil {
+				errFieldMismatch = err
+			}
+		}
+		keys = append(keys, key)
+		if sv.IsValid() {
+			sv.Set(reflect.Append(sv, elem))
+		}
+	}
+	return keys, errFieldMismatch
+}
+
+// Iterator is the result of running a query on Store.
+type Iterator struct {
+	ctx      context.Context
+	results  []*entity
+	pos      int
+	end      int
+	keysOnly bool
+	err      error
+}
+
+// Next returns the key of the next result and loads it into dst.
+// When there are no more results, Next returns iterator.Done.
+func (it *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if it.pos >= it.end {
+		return nil, iterator.Done
+	}
+	e := it.results[it.pos]
+	it.pos++
+	if !it.keysOnly && dst != nil {
+		if err := loadEntity(reflect.ValueOf(dst), e.key, e.props); err != nil {
+			return e.key, err
+		}
+	}
+	return e.key, nil
+}
+
+// Cursor returns a cursor for the iterator's current location.
+func (it *Iterator) Cursor() (datastore.Cursor, error) {
+	if it.err != nil && it.err != iterator.Done {
+		return datastore.Cursor{}, it.err
+	}
+	var last *datastore.Key
+	if it.pos > 0 {
+		last = it.results[it.pos-1].key
+	}
+	return encodeCursor(it.pos, last)
+}
+
+// run evaluates the query of info. The caller must hold the read lock.
+func (s *Store) run(info *backend.QueryDescription) (*Iterator, error) {
+	var results []*entity
+	for _, e := range s.entities {
+		ok, err := matchEntity(info, e)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results = append(results, e)
+		}
+	}
+	results = sortEntities(info.Orders, results)
+	results = project(info, results)
+
+	start, end := 0, len(results)
+	if info.Start.String() != "" {
+		pos, err := decodeCursor(info.Start, info.Orders, results)
+		if err != nil {
+			return nil, err
+		}
+		start = pos
+	}
+	if info.End.String() != "" {
+		pos, err := decodeCursor(info.End, info.Orders, results)
+		if err != nil {
+			return nil, err
+		}
+		end = pos
+	}
+	if start > end {
+		start = end
+	}
+	start += int(info.Offset)
+	if start > end {
+		start = end
+	}
+	if info.Limit >= 0 && start+int(info.Limit) < end {
+		end = start + int(info.Limit)
+	}
+	return &Iterator{results: results, pos: start, end: end, keysOnly: info.KeysOnly}, nil
+}
+
+// sortedEntities returns all entities in key order. The caller must hold the read lock.
+func (s *Store) sortedEntities() []*entity {
+	ret := make([]*entity, 0, len(s.entities))
+	for _, e := range s.entities {
+		ret = append(ret, e)
+	}
+	return sortEntities(nil, ret)
+}
+
+func matchEntity(info *backend.QueryDescription, e *entity) (bool, error) {
+	key := e.key
+	if key.Namespace != info.Namespace {
+		return false, nil
+	}
+	if info.Kind != "" && key.Kind != info.Kind {
+		return false, nil
+	}
+	if info.Ancestor != nil && !hasAncestor(key, info.Ancestor) {
+		return false, nil
+	}
+	for _, f := range info.Filters {
+		ok, err := matchFilter(f, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for k := key; k != nil; k = k.Parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFilter(f backend.QueryFilter, e *entity) (bool, error) {
+	fv := normalize(f.Value)
+	var values []interface{}
+	if f.Property == keyFieldName {
+		if _, ok := fv.(*datastore.Key); !ok {
+			return false, fmt.Errorf("memstore: %s filter value must be *datastore.Key, got %T", keyFieldName, f.Value)
+		}
+		values = []interface{}{e.key}
+	} else {
+		values = propertyValues(e.props, f.Property)
+	}
+	for _, v := range values {
+		c, ok := compareValues(v, fv)
+		if !ok {
+			continue
+		}
+		var match bool
+		switch f.Op {
+		case "<":
+			match = c < 0
+		case "<=":
+			match = c <= 0
+		case "=":
+			match = c == 0
+		case ">=":
+			match = c >= 0
+		case ">":
+			match = c > 0
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// propertyValues returns the indexed values of the property whose name is name.
+// Values of multi-valued property are flattened.
+func propertyValues(props []datastore.Property, name string) []interface{} {
+	var values []interface{}
+	for _, prop := range props {
+		if prop.Name != name || prop.NoIndex {
+			continue
+		}
+		if vs, ok := prop.Value.([]interface{}); ok {
+			values = append(values, vs...)
+			continue
+		}
+		values = append(values, prop.Value)
+	}
+	return values
+}
+
+// orderValue returns the value of e used to sort by o.
+// The second result is false if e does not have the property.
+func orderValue(o backend.QueryOrder, e *entity) (interface{}, bool) {
+	if o.Property == keyFieldName {
+		return e.key, true
+	}
+	values := propertyValues(e.props, o.Property)
+	if len(values) == 0 {
+		return nil, false
+	}
+	// multi-valued property is sorted by the smallest value in ascending order,
+	// and by the largest value in descending order.
+	ret := values[0]
+	for _, v := range values[1:] {
+		c, _ := compareValues(v, ret)
+		if (c < 0) != o.Descending && c != 0 {
+			ret = v
+		}
+	}
+	return ret, true
+}
+
+// sortEntities sorts entities by orders and then by key.
+// Entities that do not have an ordered property are removed.
+func sortEntities(orders []backend.QueryOrder, entities []*entity) []*entity {
+	type sortable struct {
+		e      *entity
+		values []interface{}
+	}
+	items := make([]sortable, 0, len(entities))
+	for _, e := range entities {
+		item := sortable{e: e, values: make([]interface{}, len(orders))}
+		ok := true
+		for i, o := range orders {
+			item.values[i], ok = orderValue(o, e)
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			items = append(items, item)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		for k, o := range orders {
+			c, _ := compareValues(items[i].values[k], items[j].values[k])
+			if o.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return keyorder.Compare(items[i].e.key, items[j].e.key) < 0
+	})
+
+	ret := make([]*entity, len(items))
+	for i, item := range items {
+		ret[i] = item.e
+	}
+	return ret
+}
+
+// project returns the entities with the projected properties.
+// Entities that do not have a projected property are removed.
+func project(info *backend.QueryDescription, entities []*entity) []*entity {
+	if len(info.Projection) == 0 {
+		return entities
+	}
+
+	var ret []*entity
+	for _, e := range entities {
+		props := make([]datastore.Property, 0, len(info.Projection))
+		for _, name := range info.Projection {
+			for _, prop := range e.props {
+				if prop.Name == name {
+					props = append(props, prop)
+					break
+				}
+			}
+		}
+		if len(props) != len(info.Projection) {
+			continue
+		}
+		ret = append(ret, &entity{key: e.key, props: props})
+	}
+	return ret
+}
+
+// encodeCursor returns the cursor at pos whose previous entity has the key last.
+func encodeCursor(pos int, last *datastore.Key) (datastore.Cursor, error) {
+	b := append([]byte(nil), cursorPrefix...)
+	b = append(b, make([]byte, binary.MaxVarintLen64)...)
+	n := binary.PutUvarint(b[len(cursorPrefix):], uint64(pos))
+	b = b[:len(cursorPrefix)+n]
+	if last != nil {
+		b = append(b, last.Encode()...)
+	}
+	return datastore.DecodeCursor(base64.URLEncoding.EncodeToString(b))
+}
+
+// decodeCursor returns the position of the cursor c in results sorted by orders.
+// The cursor is located after the entity whose key is in the cursor. If there is no such entity,
+// the cursor is located after the keys before it when results are in key order,
+// and the position in the cursor is used otherwise.
+func decodeCursor(c datastore.Cursor, orders []backend.QueryOrder, results []*entity) (int, error) {
+	// Cursor.String is the cursor in base64url without padding.
+	b, err := base64.RawURLEncoding.DecodeString(c.String())
+	if err != nil || !bytes.HasPrefix(b, cursorPrefix) {
+		return 0, errors.New("memstore: invalid cursor")
+	}
+	b = b[len(cursorPrefix):]
+	pos, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, errors.New("memstore: invalid cursor")
+	}
+	if len(b[n:]) > 0 {
+		last, err := datastore.DecodeKey(string(b[n:]))
+		if err != nil {
+			return 0, errors.New("memstore: invalid cursor")
+		}
+		for i, e := range results {
+			if e.key.Equal(last) {
+				return i + 1, nil
+			}
+		}
+		if len(orders) == 0 || (len(orders) == 1 && orders[0].Property == keyFieldName && !orders[0].Descending) {
+			return sort.Search(len(results), func(i int) bool {
+				return keyorder.Compare(results[i].key, last) > 0
+			}), nil
+		}
+	}
+	if int(pos) > len(results) {
+		return len(results), nil
+	}
+	return int(pos), nil
+}
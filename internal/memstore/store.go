@@ -0,0 +1,441 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * Package memstore implements backend.Backend on memory.
+ */
+
+package memstore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+)
+
+var (
+	// ErrAlreadyExists is returned when inserting an entity that already exists.
+	ErrAlreadyExists = errors.New("memstore: entity already exists")
+	// ErrTransactionExpired is returned when using a committed or rolled back transaction.
+	ErrTransactionExpired = errors.New("memstore: transaction expired")
+	// ErrReadOnlyTransaction is returned when writing in a read-only transaction.
+	ErrReadOnlyTransaction = errors.New("memstore: write in read-only transaction")
+)
+
+// firstID is the first ID allocated by Store.
+// It is large so that allocated IDs rarely collide with IDs set by hand.
+const firstID = 1 << 40
+
+// Change is a change of an entity applied to Store.
+type Change struct {
+	Key *datastore.Key
+	// Properties is nil when the entity is deleted.
+	Properties []datastore.Property
+	Deleted    bool
+}
+
+// Options configures Store.
+type Options struct {
+	// Persist is called with the changes and the next ID to allocate before Store applies them.
+	// If Persist returns an error, the changes are not applied.
+	Persist func(changes []Change, nextID int64) error
+}
+
+type entity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// Store is backend.Backend which stores entities on memory.
+type Store struct {
+	m        sync.RWMutex
+	entities map[string]*entity
+	// versions keeps the version of every key written, including deleted keys.
+	versions map[string]int64
+	version  int64
+	nextID   int64
+	persist  func(changes []Change, nextID int64) error
+}
+
+var _ backend.Backend = (*Store)(nil)
+
+// New generate empty Store.
+func New(opts Options) *Store {
+	return &Store{
+		entities: make(map[string]*entity),
+		versions: make(map[string]int64),
+		nextID:   firstID,
+		persist:  opts.Persist,
+	}
+}
+
+// Restore applies changes without persisting them. Restore is used to load persisted changes.
+func (s *Store) Restore(changes []Change, nextID int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.apply(changes)
+	if nextID > s.nextID {
+		s.nextID = nextID
+	}
+}
+
+// Len returns the number of entities.
+func (s *Store) Len() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return len(s.entities)
+}
+
+// Entities returns all entities in key order.
+func (s *Store) Entities() []Change {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	ret := make([]Change, 0, len(s.entities))
+	for _, e := range s.sortedEntities() {
+		ret = append(ret, Change{Key: e.key, Properties: cloneProperties(e.props)})
+	}
+	return ret
+}
+
+// Snapshot calls f with all entities in key order and the next ID to allocate.
+// No change is applied to Store while f runs.
+func (s *Store) Snapshot(f func(entities []Change, nextID int64) error) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ret := make([]Change, 0, len(s.entities))
+	for _, e := range s.sortedEntities() {
+		ret = append(ret, Change{Key: e.key, Properties: e.props})
+	}
+	return f(ret, s.nextID)
+}
+
+// NextID returns the next ID to allocate.
+func (s *Store) NextID() int64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.nextID
+}
+
+// AllocateIDs returns complete keys of incomplete keys.
+func (s *Store) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if !validKey(key, true) || !key.Incomplete() {
+			return nil, datastore.ErrInvalidKey
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	nextID := s.nextID
+	ret := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		ret[i] = completeKey(key, nextID)
+		nextID++
+	}
+	if s.persist != nil {
+		if err := s.persist(nil, nextID); err != nil {
+			return nil, err
+		}
+	}
+	s.nextID = nextID
+	return ret, nil
+}
+
+// GetMulti loads the entities of keys into dst.
+func (s *Store) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	_, err := s.getMulti(keys, dst)
+	return err
+}
+
+// GetMultiAt returns backend.ErrUnsupported, because Store keeps no history of entities.
+func (s *Store) GetMultiAt(ctx context.Context, readTime time.Time, keys []*datastore.Key, dst interface{}) error {
+	return backend.ErrUnsupported
+}
+
+// getMulti loads the entities of keys into dst and returns their versions.
+func (s *Store) getMulti(keys []*datastore.Key, dst interface{}) ([]int64, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New("memstore: keys and dst slices have different length")
+	}
+
+	versions := make([]int64, len(keys))
+	multiErr := make(datastore.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		if !validKey(key, false) {
+			multiErr[i] = datastore.ErrInvalidKey
+			hasErr = true
+			continue
+		}
+		k := key.Encode()
+		versions[i] = s.versions[k]
+		e, ok := s.entities[k]
+		if !ok {
+			multiErr[i] = datastore.ErrNoSuchEntity
+			hasErr = true
+			continue
+		}
+		if err := loadEntity(v.Index(i), e.key, e.props); err != nil {
+			multiErr[i] = err
+			hasErr = true
+		}
+	}
+	if hasErr {
+		return versions, multiErr
+	}
+	return versions, nil
+}
+
+// PutMulti saves src with keys and returns the complete keys.
+func (s *Store) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	changes, err := putChanges(keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	nextID := s.completeChanges(changes)
+	if err := s.commit(changes, nextID); err != nil {
+		return nil, err
+	}
+	ret := make([]*datastore.Key, len(changes))
+	for i, change := range changes {
+		ret[i] = change.Key
+	}
+	return ret, nil
+}
+
+// DeleteMulti deletes the entities of keys.
+func (s *Store) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	changes, err := deleteChanges(keys)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.commit(changes, s.nextID)
+}
+
+// Mutate applies muts atomically and returns the complete keys.
+func (s *Store) Mutate(ctx context.Context, muts ...*backend.Mutation) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	changes, err := mutationChanges(muts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ops := make([]backend.MutationOp, len(muts))
+	for i, mut := range muts {
+		ops[i] = mut.Op
+	}
+	if err := s.checkMutations(ops, changes); err != nil {
+		return nil, err
+	}
+	nextID := s.completeChanges(changes)
+	if err := s.commit(changes, nextID); err != nil {
+		return nil, err
+	}
+	ret := make([]*datastore.Key, len(changes))
+	for i, change := range changes {
+		ret[i] = change.Key
+	}
+	return ret, nil
+}
+
+// Close does nothing.
+func (s *Store) Close() error {
+	return nil
+}
+
+// completeChanges allocates IDs to incomplete keys of changes and returns the next ID.
+func (s *Store) completeChanges(changes []Change) int64 {
+	nextID := s.nextID
+	for i := range changes {
+		if changes[i].Key.Incomplete() {
+			changes[i].Key = completeKey(changes[i].Key, nextID)
+			nextID++
+		}
+	}
+	return nextID
+}
+
+// checkMutations checks that inserted entities do not exist and updated entities exist.
+func (s *Store) checkMutations(ops []backend.MutationOp, changes []Change) error {
+	exists := make(map[string]bool)
+	for i, op := range ops {
+		key := changes[i].Key
+		if key.Incomplete() {
+			continue
+		}
+		k := key.Encode()
+		exist, ok := exists[k]
+		if !ok {
+			_, exist = s.entities[k]
+		}
+		switch op {
+		case backend.MutationInsert:
+			if exist {
+				return ErrAlreadyExists
+			}
+		case backend.MutationUpdate:
+			if !exist {
+				return datastore.ErrNoSuchEntity
+			}
+		}
+		exists[k] = !changes[i].Deleted
+	}
+	return nil
+}
+
+// commit persists and applies changes. The caller must hold the write lock.
+func (s *Store) commit(changes []Change, nextID int64) error {
+	if s.persist != nil {
+		if err := s.persist(changes, nextID); err != nil {
+			return err
+		}
+	}
+	s.apply(changes)
+	if nextID > s.nextID {
+		s.nextID = nextID
+	}
+	return nil
+}
+
+func (s *Store) apply(changes []Change) {
+	s.version++
+	for _, change := range changes {
+		k := change.Key.Encode()
+		s.versions[k] = s.version
+		if change.Deleted {
+			delete(s.entities, k)
+			continue
+		}
+		s.entities[k] = &entity{key: change.Key, props: cloneProperties(change.Properties)}
+		if change.Key.Name == "" && change.Key.ID >= s.nextID {
+			s.nextID = change.Key.ID + 1
+		}
+	}
+}
+
+func putChanges(keys []*datastore.Key, src interface{}) ([]Change, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New("memstore: keys and src slices have different length")
+	}
+
+	changes := make([]Change, len(keys))
+	multiErr := make(datastore.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		if !validKey(key, true) {
+			multiErr[i] = datastore.ErrInvalidKey
+			hasErr = true
+			continue
+		}
+		props, err := saveEntity(v.Index(i))
+		if err != nil {
+			multiErr[i] = err
+			hasErr = true
+			continue
+		}
+		changes[i] = Change{Key: key, Properties: props}
+	}
+	if hasErr {
+		return nil, multiErr
+	}
+	return changes, nil
+}
+
+func deleteChanges(keys []*datastore.Key) ([]Change, error) {
+	changes := make([]Change, len(keys))
+	multiErr := make(datastore.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		if !validKey(key, false) {
+			multiErr[i] = datastore.ErrInvalidKey
+			hasErr = true
+			continue
+		}
+		changes[i] = Change{Key: key, Deleted: true}
+	}
+	if hasErr {
+		return nil, multiErr
+	}
+	return changes, nil
+}
+
+func mutationChanges(muts []*backend.Mutation) ([]Change, error) {
+	changes := make([]Change, len(muts))
+	for i, mut := range muts {
+		key := mut.Key
+		if mut.Op == backend.MutationDelete {
+			if !validKey(key, false) {
+				return nil, datastore.ErrInvalidKey
+			}
+			changes[i] = Change{Key: key, Deleted: true}
+			continue
+		}
+		if !validKey(key, true) {
+			return nil, datastore.ErrInvalidKey
+		}
+		changes[i] = Change{Key: key, Properties: cloneProperties(mut.Properties)}
+	}
+	return changes, nil
+}
+
+// validKey reports whether key is valid. Incomplete keys are valid only if allowIncomplete.
+func validKey(key *datastore.Key, allowIncomplete bool) bool {
+	if key == nil || key.Kind == "" || (key.ID != 0 && key.Name != "") {
+		return false
+	}
+	if !allowIncomplete && key.Incomplete() {
+		return false
+	}
+	for p := key.Parent; p != nil; p = p.Parent {
+		if p.Kind == "" || p.Incomplete() || p.Namespace != key.Namespace {
+			return false
+		}
+	}
+	return true
+}
+
+func completeKey(key *datastore.Key, id int64) *datastore.Key {
+	ret := datastore.IDKey(key.Kind, id, key.Parent)
+	ret.Namespace = key.Namespace
+	return ret
+}
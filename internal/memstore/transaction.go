@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for optimistic transaction on memory.
+ */
+
+package memstore
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+)
+
+// defaultMaxAttempts is the number of attempts of RunInTransaction, which is the same as datastore.
+const defaultMaxAttempts = 3
+
+// Transaction is an optimistic transaction of Store.
+//
+// Transaction records the versions of the entities that it reads and writes,
+// and Commit returns datastore.ErrConcurrentTransaction if another write changed them.
+type Transaction struct {
+	m        sync.Mutex
+	store    *Store
+	ctx      context.Context
+	readOnly bool
+	// start is the version of store when the transaction started.
+	start int64
+	// keys are the keys that the transaction read or wrote.
+	keys map[string]bool
+	// ancestors are the ancestors of the queries that the transaction ran.
+	ancestors []*datastore.Key
+	writes    []write
+	done      bool
+}
+
+type write struct {
+	change  Change
+	op      backend.MutationOp
+	pending *PendingKey
+}
+
+// PendingKey is the key of an entity put in Transaction.
+type PendingKey struct {
+	key *datastore.Key
+}
+
+// Commit is the result of committed Transaction.
+type Commit struct {
+	keys map[*PendingKey]*datastore.Key
+}
+
+// Key resolves p to the complete key.
+func (c *Commit) Key(p backend.PendingKey) *datastore.Key {
+	pk, ok := p.(*PendingKey)
+	if !ok {
+		panic("memstore: PendingKey is not of this store")
+	}
+	return c.keys[pk]
+}
+
+type transactionSettings struct {
+	readOnly    bool
+	maxAttempts int
+}
+
+func newTransactionSettings(opts []datastore.TransactionOption) transactionSettings {
+	s := transactionSettings{maxAttempts: defaultMaxAttempts}
+	for _, opt := range opts {
+		if opt == datastore.ReadOnly {
+			s.readOnly = true
+			continue
+		}
+		// datastore.MaxAttempts is not readable, so only backend.MaxAttempts sets the number of attempts.
+		if m, ok := opt.(backend.MaxAttempts); ok {
+			s.maxAttempts = m.Attempts
+		}
+	}
+	return s
+}
+
+// NewTransaction starts a new transaction.
+func (s *Store) NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (backend.Transaction, error) {
+	return s.newTransaction(ctx, newTransactionSettings(opts))
+}
+
+func (s *Store) newTransaction(ctx context.Context, settings transactionSettings) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return &Transaction{
+		store:    s,
+		ctx:      ctx,
+		readOnly: settings.readOnly,
+		start:    s.version,
+		keys:     make(map[string]bool),
+	}, nil
+}
+
+// RunInTransaction runs f in a transaction and commits it.
+// If the commit conflicts with another write, f is retried up to the attempts of datastore.MaxAttempts.
+func (s *Store) RunInTransaction(ctx context.Context, f func(tx backend.Transaction) error, opts ...datastore.TransactionOption) (backend.Commit, error) {
+	settings := newTransactionSettings(opts)
+	for attempt := 0; attempt < settings.maxAttempts; attempt++ {
+		tx, err := s.newTransaction(ctx, settings)
+		if err != nil {
+			return nil, err
+		}
+		if err := f(tx); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		cmt, err := tx.Commit()
+		if err == datastore.ErrConcurrentTransaction {
+			continue
+		}
+		return cmt, err
+	}
+	return nil, datastore.ErrConcurrentTransaction
+}
+
+// GetMulti loads the entities of keys into dst.
+// GetMulti reads the committed entities and does not see the writes of the transaction.
+func (t *Transaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	t.store.m.RLock()
+	defer t.store.m.RUnlock()
+
+	versions, err := t.store.getMulti(keys, dst)
+	if versions == nil {
+		return err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	for i, key := range keys {
+		if versions[i] > t.start {
+			return datastore.ErrConcurrentTransaction
+		}
+		if validKey(key, false) {
+			t.keys[key.Encode()] = true
+		}
+	}
+	return err
+}
+
+// Run runs the ancestor query q.
+// Like GetMulti, Run reads the committed entities and does not see the writes of the transaction.
+func (t *Transaction) Run(q *backend.Query) backend.Iterator {
+	if err := t.check(false); err != nil {
+		return &Iterator{err: err}
+	}
+	info, err := describe(t.ctx, q)
+	if err != nil {
+		return &Iterator{err: err}
+	}
+	if info.Ancestor == nil {
+		return &Iterator{err: backend.ErrNoAncestor}
+	}
+
+	t.store.m.RLock()
+	defer t.store.m.RUnlock()
+
+	it, err := t.store.run(info)
+	if err != nil {
+		return &Iterator{err: err}
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, e := range it.results {
+		k := e.key.Encode()
+		if t.store.versions[k] > t.start {
+			return &Iterator{err: datastore.ErrConcurrentTransaction}
+		}
+		t.keys[k] = true
+	}
+	t.ancestors = append(t.ancestors, info.Ancestor)
+	it.ctx = t.ctx
+	return it
+}
+
+// GetAll runs the ancestor query q and appends the entities to dst.
+func (t *Transaction) GetAll(q *backend.Query, dst interface{}) ([]*datastore.Key, error) {
+	info, err := describe(t.ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return getAll(t.Run(&backend.Query{Description: info}), info, dst)
+}
+
+// PutMulti enqueues saving src with keys.
+func (t *Transaction) PutMulti(keys []*datastore.Key, src interface{}) ([]backend.PendingKey, error) {
+	if err := t.check(true); err != nil {
+		return nil, err
+	}
+	changes, err := putChanges(keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	ret := make([]backend.PendingKey, len(changes))
+	for i, change := range changes {
+		ret[i] = t.enqueue(change, backend.MutationUpsert)
+	}
+	return ret, nil
+}
+
+// DeleteMulti enqueues deleting the entities of keys.
+func (t *Transaction) DeleteMulti(keys []*datastore.Key) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	changes, err := deleteChanges(keys)
+	if err != nil {
+		return err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, change := range changes {
+		t.enqueue(change, backend.MutationDelete)
+	}
+	return nil
+}
+
+// Mutate enqueues muts.
+func (t *Transaction) Mutate(muts ...*backend.Mutation) ([]backend.PendingKey, error) {
+	if err := t.check(true); err != nil {
+		return nil, err
+	}
+	changes, err := mutationChanges(muts)
+	if err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	ret := make([]backend.PendingKey, len(changes))
+	for i, change := range changes {
+		ret[i] = t.enqueue(change, muts[i].Op)
+	}
+	return ret, nil
+}
+
+// enqueue adds change to the writes. The caller must hold t.m.
+func (t *Transaction) enqueue(change Change, op backend.MutationOp) *PendingKey {
+	pkey := &PendingKey{key: change.Key}
+	if !change.Key.Incomplete() {
+		t.keys[change.Key.Encode()] = true
+	}
+	t.writes = append(t.writes, write{change: change, op: op, pending: pkey})
+	return pkey
+}
+
+// Commit applies the enqueued operations atomically.
+func (t *Transaction) Commit() (backend.Commit, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.done = true
+
+	s := t.store
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k := range t.keys {
+		if s.versions[k] > t.start {
+			return nil, datastore.ErrConcurrentTransaction
+		}
+	}
+	if t.changedUnderAncestors() {
+		return nil, datastore.ErrConcurrentTransaction
+	}
+
+	changes := make([]Change, len(t.writes))
+	ops := make([]backend.MutationOp, len(t.writes))
+	for i, w := range t.writes {
+		changes[i] = w.change
+		ops[i] = w.op
+	}
+	if err := s.checkMutations(ops, changes); err != nil {
+		return nil, err
+	}
+
+	nextID := s.completeChanges(changes)
+	if err := s.commit(changes, nextID); err != nil {
+		return nil, err
+	}
+
+	cmt := &Commit{keys: make(map[*PendingKey]*datastore.Key, len(t.writes))}
+	for i, w := range t.writes {
+		cmt.keys[w.pending] = changes[i].Key
+	}
+	return cmt, nil
+}
+
+// changedUnderAncestors reports whether an entity under the ancestors of the queries was written
+// after the transaction started. The caller must hold the lock of the store.
+func (t *Transaction) changedUnderAncestors() bool {
+	if len(t.ancestors) == 0 {
+		return false
+	}
+	for k, version := range t.store.versions {
+		if version <= t.start {
+			continue
+		}
+		key, err := datastore.DecodeKey(k)
+		if err != nil {
+			continue
+		}
+		for _, ancestor := range t.ancestors {
+			if hasAncestor(key, ancestor) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Rollback abandons the transaction.
+func (t *Transaction) Rollback() error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.done = true
+	return nil
+}
+
+// check returns an error if the transaction cannot be used.
+func (t *Transaction) check(write bool) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.done {
+		return ErrTransactionExpired
+	}
+	if write && t.readOnly {
+		return ErrReadOnlyTransaction
+	}
+	return nil
+}
@@ -7,7 +7,6 @@
 package gonm
 
 import (
-	"fmt"
 	"reflect"
 	"strings"
 
@@ -17,7 +16,7 @@ import (
 func extractKeys(src interface{}, putRequest bool) (key []*datastore.Key, err error) {
 	v := reflect.Indirect(reflect.ValueOf(src))
 	if v.Kind() != reflect.Slice {
-		return nil, fmt.Errorf("gonm: value must be a slice or pointer-to-slice")
+		return nil, invalidType(src, "a slice or pointer-to-slice")
 	}
 	l := v.Len()
 
@@ -29,7 +28,7 @@ func extractKeys(src interface{}, putRequest bool) (key []*datastore.Key, err er
 			return nil, err
 		}
 		if !putRequest && key.Incomplete() {
-			return nil, fmt.Errorf("gonm: cannot find a pkey for struct - %v", vi.Interface())
+			return nil, &KeyError{Type: vi.Type(), Key: key, Err: ErrIncompleteKey}
 		}
 		keys[i] = key
 	}
@@ -45,7 +44,7 @@ func getStructKey(src interface{}) (key *datastore.Key, err error) {
 	k := t.Kind()
 
 	if k != reflect.Struct {
-		err = fmt.Errorf("gonm: Expected struct, got instead: %v", k)
+		err = invalidType(src, "struct")
 		return
 	}
 
@@ -71,18 +70,18 @@ func getStructKey(src interface{}) (key *datastore.Key, err error) {
 			switch vf.Kind() {
 			case reflect.Int64:
 				if intID != 0 || stringID != "" {
-					err = fmt.Errorf("gonm: Only one field may be marked id")
+					err = &FieldError{Type: t, Field: tf.Name, Tag: "id", Err: ErrDuplicateKeyField}
 					return
 				}
 				intID = vf.Int()
 			case reflect.String:
 				if intID != 0 || stringID != "" {
-					err = fmt.Errorf("gonm: Only one field may be marked id")
+					err = &FieldError{Type: t, Field: tf.Name, Tag: "id", Err: ErrDuplicateKeyField}
 					return
 				}
 				stringID = vf.String()
 			default:
-				err = fmt.Errorf("gonm: ID field must be int64 or string in %v", t.Name())
+				err = &FieldError{Type: t, Field: tf.Name, Tag: "id", Err: ErrUnsupportedIDType}
 				return
 			}
 			hasKeyField = true
@@ -90,7 +89,7 @@ func getStructKey(src interface{}) (key *datastore.Key, err error) {
 		case tagValue == "kind":
 			if vf.Kind() == reflect.String {
 				if kind != "" {
-					err = fmt.Errorf("gonm: Only one field may be marked kind")
+					err = &FieldError{Type: t, Field: tf.Name, Tag: "kind", Err: ErrDuplicateKeyField}
 					return
 				}
 				kind = vf.String()
@@ -103,7 +102,7 @@ func getStructKey(src interface{}) (key *datastore.Key, err error) {
 			dskeyType := reflect.TypeOf(&datastore.Key{})
 			if vf.Type().ConvertibleTo(dskeyType) {
 				if parent != nil {
-					err = fmt.Errorf("gonm: Only one field may be marked parent")
+					err = &FieldError{Type: t, Field: tf.Name, Tag: "parent", Err: ErrDuplicateKeyField}
 					return
 				}
 				parent = vf.Convert(dskeyType).Interface().(*datastore.Key)
@@ -136,7 +135,7 @@ func setStructKey(src interface{}, key *datastore.Key) error {
 	k := t.Kind()
 
 	if k != reflect.Ptr {
-		return fmt.Errorf("gonm: Expected pointer to struct, got instead: %v", k)
+		return invalidType(src, "pointer to a struct")
 	}
 
 	v = reflect.Indirect(v)
@@ -144,7 +143,7 @@ func setStructKey(src interface{}, key *datastore.Key) error {
 	k = t.Kind()
 
 	if k != reflect.Struct {
-		return fmt.Errorf(fmt.Sprintf("gonm: Expected struct, got instead: %v", k))
+		return invalidType(src, "pointer to a struct")
 	}
 
 	idSet := false
@@ -168,17 +167,21 @@ func setStructKey(src interface{}, key *datastore.Key) error {
 		switch {
 		case tagValue == "id" || tf.Name == "ID":
 			if idSet {
-				return fmt.Errorf("gonm: Only one field may be marked id")
+				return &FieldError{Type: t, Field: tf.Name, Tag: "id", Err: ErrDuplicateKeyField}
 			}
 
-			if vf.Kind() == reflect.Int64 {
+			switch vf.Kind() {
+			case reflect.Int64:
 				vf.SetInt(key.ID)
 				idSet = true
+			case reflect.String:
+				vf.SetString(key.Name)
+				idSet = true
 			}
 
 		case tagValue == "kind":
 			if kindSet {
-				return fmt.Errorf("gonm: Only one field may be marked kind")
+				return &FieldError{Type: t, Field: tf.Name, Tag: "kind", Err: ErrDuplicateKeyField}
 			}
 			if vf.Kind() == reflect.String {
 				vf.Set(reflect.ValueOf(key.Kind))
@@ -187,7 +190,7 @@ func setStructKey(src interface{}, key *datastore.Key) error {
 
 		case tagValue == "parent" || tf.Name == "Parent":
 			if parentSet {
-				return fmt.Errorf("gonm: Only one field may be marked parent")
+				return &FieldError{Type: t, Field: tf.Name, Tag: "parent", Err: ErrDuplicateKeyField}
 			}
 			dskeyType := reflect.TypeOf(&datastore.Key{})
 			vfType := vf.Type()
@@ -1,6 +1,8 @@
 package gonm
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 
 	"cloud.google.com/go/datastore"
@@ -73,6 +75,41 @@ func TestGetStructKey(t *testing.T) {
 	assert.Error(err, "gonm: At least one ID or id tag in testModel3")
 }
 
+func TestKeyErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := extractKeys(testModel{}, false)
+	assert.True(errors.Is(err, ErrInvalidDestination), "not slice")
+	var typeErr *InvalidTypeError
+	if assert.True(errors.As(err, &typeErr)) {
+		assert.Equal(reflect.TypeOf(testModel{}), typeErr.Type)
+	}
+
+	_, err = extractKeys([]testModel{{}}, false)
+	assert.True(errors.Is(err, ErrIncompleteKey), "incomplete key on get")
+
+	type duplicateID struct {
+		ID    int64
+		Other int64 `gonm:"id"`
+	}
+	_, err = getStructKey(duplicateID{ID: 1, Other: 2})
+	assert.True(errors.Is(err, ErrDuplicateKeyField), "duplicate id")
+	var fieldErr *FieldError
+	if assert.True(errors.As(err, &fieldErr)) {
+		assert.Equal("Other", fieldErr.Field)
+		assert.Equal("id", fieldErr.Tag)
+	}
+
+	type floatID struct {
+		ID float64
+	}
+	_, err = getStructKey(floatID{ID: 1})
+	assert.True(errors.Is(err, ErrUnsupportedIDType), "float id")
+
+	err = setStructKey(testModel{}, datastore.IDKey("testModel", 1, nil))
+	assert.True(errors.Is(err, ErrInvalidDestination), "not pointer")
+}
+
 func TestSetStructKey(t *testing.T) {
 	parentKey := datastore.IDKey("test", 2, nil)
 	key := datastore.IDKey("test", 1, parentKey)
@@ -84,6 +121,14 @@ func TestSetStructKey(t *testing.T) {
 	assert.Equal(t, "test", test.Kind, "kind property set kind of pkey")
 	assert.Equal(t, int64(1), test.IDOther, "id property set id of pkey")
 	assert.Equal(t, parentKey, test.Parent, "parent property set parent pkey of pkey")
+
+	named := &struct {
+		Code string `datastore:"-" gonm:"id"`
+	}{}
+	if err := setStructKey(named, datastore.NameKey("test", "a", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a", named.Code, "string id property set name of pkey")
 }
 
 func TestKind(t *testing.T) {
@@ -6,18 +6,39 @@ import (
 	"testing"
 
 	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/memstore"
 )
 
+// testDsClient is the client of the Datastore emulator. It is nil when DATASTORE_EMULATOR_HOST is not set.
 var testDsClient *datastore.Client
 
 func TestMain(m *testing.M) {
 	ctx := context.Background()
-	client, err := datastore.NewClient(ctx, "")
-	if err != nil {
-		panic(err)
+	if os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		client, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			panic(err)
+		}
+		defer client.Close()
+		testDsClient = client
 	}
-	defer client.Close()
-	testDsClient = client
 
 	os.Exit(m.Run())
 }
+
+// newTestGonm generates Gonm on the Datastore emulator.
+// Without the emulator, it generates Gonm on a new memory backend, so the tests run without Datastore.
+func newTestGonm(ctx context.Context) *Gonm {
+	if testDsClient == nil {
+		return fromBackend(ctx, memstore.New(memstore.Options{}))
+	}
+	return newTestGonm(ctx)
+}
+
+// requireDatastore skips the test which depends on the behavior of Google Cloud Datastore.
+func requireDatastore(t testing.TB) {
+	t.Helper()
+	if testDsClient == nil {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+}
@@ -7,66 +7,101 @@
 package gonm
 
 import (
-	"fmt"
 	"reflect"
 
 	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
 )
 
 // Mutation is wrapper of datastore.Mutation
+//
+// The entity is saved when the mutation is generated, so the changes of the structure after that are not applied.
 type Mutation struct {
 	mutation *datastore.Mutation
+	op       backend.MutationOp
 	src      interface{}
 	key      *datastore.Key
-	err      error
+	// props is the entity saved when the mutation is generated.
+	props []datastore.Property
+	err   error
 }
 
 // Mutate run GonMutations. If this method run success, all structures are complemented with IDs.
 // In transaction, Mutate return nil as []*datastore.Key when success
 func (gm *Gonm) Mutate(gmuts ...*Mutation) (ret []*datastore.Key, err error) {
-	muts := make([]*datastore.Mutation, len(gmuts))
+	if gm.readOnly {
+		return nil, gm.stackError("Mutate", nil, ErrReadOnly)
+	}
 	var merr []error
-	for i, gmut := range gmuts {
+	for _, gmut := range gmuts {
 		if gmut.err != nil {
 			merr = append(merr, gmut.err)
-			_ = gm.stackError(gmut.err)
+			_ = gm.stackError("Mutate", nil, gmut.err)
 		}
-		muts[i] = gmut.mutation
 	}
 
 	if len(merr) > 0 {
 		return nil, merr[0]
 	}
 
-	if gm.Transaction != nil {
-		pret, err := gm.Transaction.Mutate(muts...)
+	var (
+		saveKeys []*datastore.Key
+		saveSrcs []reflect.Value
+		saveIdx  []int
+		versions []versionedStruct
+	)
+	for i, gmut := range gmuts {
+		if gmut.op == backend.MutationDelete {
+			continue
+		}
+		sv := structValue(reflect.ValueOf(gmut.src))
+		if _, ok, err := versionField(sv); ok || err != nil {
+			saveKeys = append(saveKeys, gmut.key)
+			saveSrcs = append(saveSrcs, sv)
+			saveIdx = append(saveIdx, i)
+		}
+	}
+	muts := backendMutations(gmuts)
+	if len(saveKeys) > 0 {
+		if gm.tx == nil {
+			return gm.mutateInTransaction(gmuts)
+		}
+		versions, err = gm.checkVersions(saveKeys, saveSrcs)
+		if err != nil {
+			return nil, gm.stackError("Mutate", saveKeys, err)
+		}
+		// The entities were saved with the old versions, so the mutations are rebuilt with the incremented versions.
+		for i, idx := range saveIdx {
+			muts[idx] = gmuts[idx].withVersion(versionProperty(saveSrcs[i].Type()), versions[i].version)
+		}
+	}
+
+	if gm.tx != nil {
+		pret, err := gm.tx.Mutate(muts...)
 		if err != nil {
-			return nil, gm.stackError(err)
+			return nil, gm.stackError("Mutate", nil, err)
+		}
+		if versions != nil {
+			gm.pending.addVersions(versions)
 		}
 
 		for i, key := range pret {
 			if gmuts[i].key.Incomplete() {
-				gm.m.Lock()
-				gm.pending = append(gm.pending,
-					&pendingStruct{
-						pkey: key,
-						dst:  gmuts[i].src,
-					})
-				gm.m.Unlock()
+				gm.pending.add(key, gmuts[i].src)
 			} else {
-				gm.cache.delete(gmuts[i].key)
+				gm.invalidate(gmuts[i].key)
 			}
 		}
 	} else {
-		ret, err = gm.Client.Mutate(gm.Context, muts...)
+		ret, err = gm.backend.Mutate(gm.Context, muts...)
 		if err != nil {
-			return nil, gm.stackError(err)
+			return nil, gm.stackError("Mutate", nil, err)
 		}
 
 		for i, gmut := range gmuts {
 			if gmut.key.Incomplete() {
 				if err = setStructKey(gmut.src, ret[i]); err != nil {
-					return ret, gm.stackError(err)
+					return ret, gm.stackError("Mutate", nil, err)
 				}
 			} else {
 				gm.cache.delete(ret[i])
@@ -76,30 +111,64 @@ func (gm *Gonm) Mutate(gmuts ...*Mutation) (ret []*datastore.Key, err error) {
 	return
 }
 
-// NewDelete generate Delete Mutation.
-// Dst is required *S.
-func NewDelete(dst interface{}) (gmut *Mutation) {
-	gmut = &Mutation{}
-	key, err := getStructKey(dst)
+// mutateInTransaction runs gmuts in a new transaction to check version fields of the mutations.
+func (gm *Gonm) mutateInTransaction(gmuts []*Mutation) ([]*datastore.Key, error) {
+	_, err := gm.RunInTransaction(func(tx *Gonm) error {
+		_, err := tx.Mutate(gmuts...)
+		return err
+	})
 	if err != nil {
-		gmut.err = err
-		return gmut
+		return nil, err
 	}
 
-	gmut.src = dst
-	gmut.key = key
-	gmut.mutation = datastore.NewDelete(key)
+	ret := make([]*datastore.Key, len(gmuts))
+	for i, gmut := range gmuts {
+		if gmut.op == backend.MutationDelete {
+			ret[i] = gmut.key
+			continue
+		}
+		if ret[i], err = getStructKey(gmut.src); err != nil {
+			return nil, gm.stackError("Mutate", nil, err)
+		}
+	}
+	return ret, nil
+}
 
-	return gmut
+func backendMutations(gmuts []*Mutation) []*backend.Mutation {
+	ret := make([]*backend.Mutation, len(gmuts))
+	for i, gmut := range gmuts {
+		ret[i] = &backend.Mutation{Op: gmut.op, Key: gmut.key, Properties: gmut.props, Datastore: gmut.mutation}
+	}
+	return ret
 }
 
-// NewInsert generate Insert Mutation. Returning an error if k exist.
-// Dst is required *S.
-func NewInsert(dst interface{}) (gmut *Mutation) {
-	gmut = &Mutation{}
+// withVersion returns the mutation of gmut whose entity has version as the property of the version field.
+// If property is empty, the version field is not saved and the mutation of gmut is returned.
+func (gmut *Mutation) withVersion(property string, version int64) *backend.Mutation {
+	if property == "" {
+		return backendMutations([]*Mutation{gmut})[0]
+	}
+	props := make([]datastore.Property, 0, len(gmut.props)+1)
+	found := false
+	for _, prop := range gmut.props {
+		if prop.Name == property {
+			prop.Value = version
+			found = true
+		}
+		props = append(props, prop)
+	}
+	if !found {
+		props = append(props, datastore.Property{Name: property, Value: version})
+	}
+	return &backend.Mutation{Op: gmut.op, Key: gmut.key, Properties: props, Datastore: newDatastoreMutation(gmut.op, gmut.key, props)}
+}
+
+// newSaveMutation generate the Mutation of op which saves dst.
+func newSaveMutation(op backend.MutationOp, dst interface{}) *Mutation {
+	gmut := &Mutation{op: op}
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
-		gmut.err = fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst)
+		gmut.err = invalidType(dst, "pointer to a struct")
 		return gmut
 	}
 	key, err := getStructKey(dst)
@@ -107,23 +176,44 @@ func NewInsert(dst interface{}) (gmut *Mutation) {
 		gmut.err = err
 		return gmut
 	}
+	props, err := saveProperties(dst)
+	if err != nil {
+		gmut.err = err
+		return gmut
+	}
 
 	gmut.src = dst
 	gmut.key = key
-	gmut.mutation = datastore.NewInsert(key, dst)
-
+	gmut.props = props
+	gmut.mutation = newDatastoreMutation(op, key, props)
 	return gmut
 }
 
-// NewUpdate generate Update Mutation. Returning an error if k does not exist.
+// saveProperties returns the properties of the entity of src.
+func saveProperties(src interface{}) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(src)
+}
+
+// newDatastoreMutation returns the mutation of datastore which saves props with key.
+func newDatastoreMutation(op backend.MutationOp, key *datastore.Key, props []datastore.Property) *datastore.Mutation {
+	pl := datastore.PropertyList(props)
+	switch op {
+	case backend.MutationInsert:
+		return datastore.NewInsert(key, &pl)
+	case backend.MutationUpdate:
+		return datastore.NewUpdate(key, &pl)
+	default:
+		return datastore.NewUpsert(key, &pl)
+	}
+}
+
+// NewDelete generate Delete Mutation.
 // Dst is required *S.
-func NewUpdate(dst interface{}) (gmut *Mutation) {
+func NewDelete(dst interface{}) (gmut *Mutation) {
 	gmut = &Mutation{}
-	v := reflect.ValueOf(dst)
-	if v.Kind() != reflect.Ptr {
-		gmut.err = fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst)
-		return gmut
-	}
 	key, err := getStructKey(dst)
 	if err != nil {
 		gmut.err = err
@@ -132,29 +222,26 @@ func NewUpdate(dst interface{}) (gmut *Mutation) {
 
 	gmut.src = dst
 	gmut.key = key
-	gmut.mutation = datastore.NewUpdate(key, dst)
+	gmut.mutation = datastore.NewDelete(key)
+	gmut.op = backend.MutationDelete
 
 	return gmut
 }
 
-// NewUpsert generate Upsert Mutation. Returning no error whether or not k exists.
+// NewInsert generate Insert Mutation. Returning an error if k exist.
 // Dst is required *S.
-func NewUpsert(dst interface{}) (gmut *Mutation) {
-	gmut = &Mutation{}
-	v := reflect.ValueOf(dst)
-	if v.Kind() != reflect.Ptr {
-		gmut.err = fmt.Errorf("gonm: expected pointer to a struct, got %#v", dst)
-		return gmut
-	}
-	key, err := getStructKey(dst)
-	if err != nil {
-		gmut.err = err
-		return gmut
-	}
+func NewInsert(dst interface{}) (gmut *Mutation) {
+	return newSaveMutation(backend.MutationInsert, dst)
+}
 
-	gmut.src = dst
-	gmut.key = key
-	gmut.mutation = datastore.NewUpsert(key, dst)
+// NewUpdate generate Update Mutation. Returning an error if k does not exist.
+// Dst is required *S.
+func NewUpdate(dst interface{}) (gmut *Mutation) {
+	return newSaveMutation(backend.MutationUpdate, dst)
+}
 
-	return gmut
+// NewUpsert generate Upsert Mutation. Returning no error whether or not k exists.
+// Dst is required *S.
+func NewUpsert(dst interface{}) (gmut *Mutation) {
+	return newSaveMutation(backend.MutationUpsert, dst)
 }
@@ -13,7 +13,7 @@ func TestGonm_Mutate(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	t.Run("normal mutate", func(t *testing.T) {
 		putModel := []*testModel{
@@ -46,7 +46,7 @@ func TestGonm_Mutate(t *testing.T) {
 
 		single := &testModel{ID: 1}
 		err = gm.Get(single)
-		gm.Errors = nil
+		gm.Errors.Reset()
 		assert.Error(t, err, datastore.ErrNoSuchEntity)
 	})
 
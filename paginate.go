@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for pagination
+ */
+
+package gonm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"google.golang.org/api/iterator"
+)
+
+// Page is a page of query results returned by Paginate.
+type Page struct {
+	// Keys are the keys of the entities in the page.
+	Keys []*datastore.Key
+	// NextToken is the token of the next page. NextToken is empty when HasMore is false.
+	NextToken string
+	// PrevToken is the token of the previous page. PrevToken is empty on the first page.
+	// PrevToken goes back only one page: the page got with PrevToken has no PrevToken,
+	// because a token does not hold the cursors of all the pages before it.
+	PrevToken string
+	// HasMore reports whether there are more results after the page.
+	HasMore bool
+}
+
+// pageToken is the content of page token.
+type pageToken struct {
+	// Cursor is the start cursor of the page of the token, which is empty for the first page.
+	Cursor string `json:"c,omitempty"`
+	// Prev is the start cursor of the previous page. Prev is used only when HasPrev is true.
+	Prev string `json:"p,omitempty"`
+	// HasPrev reports whether the token knows the previous page.
+	HasPrev bool `json:"h,omitempty"`
+}
+
+// Paginate runs q and appends the entities of the page of token to dst.
+// The first page is got with the empty token, and the other pages with the tokens of Page.
+//
+// Tokens are signed with PageTokenKey, and bound to q and pageSize,
+// so a tampered token or a token of another query is rejected with ErrInvalidPageToken.
+// Paginate sets the start and the limit of q, so q with start, end, limit or offset returns *QueryError.
+// If pageSize is not positive, ErrInvalidPageSize is returned.
+//
+// A token holds only the cursors of its page and the previous page, so that it does not grow with the number of pages.
+// Therefore going back with PrevToken is limited to one page, and the page got with PrevToken has no PrevToken.
+// All appended structures are complemented with their keys. dst may be nil for keys-only query.
+func (gm *Gonm) Paginate(q *Query, pageSize int, token string, dst interface{}) (*Page, error) {
+	if len(gm.PageTokenKey) == 0 {
+		return nil, gm.stackError("Paginate", nil, ErrNoPageTokenKey)
+	}
+	if pageSize <= 0 {
+		return nil, gm.stackError("Paginate", nil, ErrInvalidPageSize)
+	}
+	var sv reflect.Value
+	if dst != nil {
+		v := reflect.ValueOf(dst)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+			return nil, gm.stackError("Paginate", nil, invalidType(dst, "pointer to a slice"))
+		}
+		sv = v.Elem()
+	}
+
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, gm.stackError("Paginate", nil, err)
+	}
+	if err := checkPageQuery(bq.Description); err != nil {
+		return nil, gm.stackError("Paginate", nil, err)
+	}
+	shape := queryShape(bq.Description, pageSize)
+	pt := &pageToken{}
+	if token != "" {
+		if pt, err = gm.decodePageToken(token, shape); err != nil {
+			return nil, gm.stackError("Paginate", nil, err)
+		}
+	}
+
+	rq := q.Limit(pageSize + 1)
+	if pt.Cursor != "" {
+		c, err := datastore.DecodeCursor(pt.Cursor)
+		if err != nil {
+			return nil, gm.stackError("Paginate", nil, ErrInvalidPageToken)
+		}
+		rq = rq.Start(c)
+	}
+	rbq, err := rq.backendQuery()
+	if err != nil {
+		return nil, gm.stackError("Paginate", nil, err)
+	}
+	it, err := gm.run("Paginate", rbq, false)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	for len(page.Keys) < pageSize {
+		var elem, ptr reflect.Value
+		var d interface{}
+		if sv.IsValid() {
+			elem, ptr = newSliceElem(sv.Type().Elem())
+			d = ptr.Interface()
+		}
+		key, err := it.Next(d)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		page.Keys = append(page.Keys, key)
+		if sv.IsValid() {
+			sv.Set(reflect.Append(sv, elem))
+		}
+	}
+
+	if len(page.Keys) == pageSize {
+		cursor, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		_, err = it.Next(nil)
+		switch err {
+		case nil:
+			page.HasMore = true
+			next := &pageToken{Cursor: cursor.String(), Prev: pt.Cursor, HasPrev: true}
+			if page.NextToken, err = gm.encodePageToken(next, shape); err != nil {
+				return nil, gm.stackError("Paginate", nil, err)
+			}
+		case iterator.Done:
+		default:
+			return nil, err
+		}
+	}
+	if pt.HasPrev {
+		if page.PrevToken, err = gm.encodePageToken(&pageToken{Cursor: pt.Prev}, shape); err != nil {
+			return nil, gm.stackError("Paginate", nil, err)
+		}
+	}
+	return page, nil
+}
+
+// checkPageQuery returns *QueryError if the query of info has start, end, limit or offset,
+// which conflict with the start and the limit set by Paginate.
+func checkPageQuery(info *backend.QueryDescription) error {
+	var parts []string
+	if info.Start.String() != "" {
+		parts = append(parts, "start")
+	}
+	if info.End.String() != "" {
+		parts = append(parts, "end")
+	}
+	if info.Limit >= 0 {
+		parts = append(parts, "limit")
+	}
+	if info.Offset != 0 {
+		parts = append(parts, "offset")
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return &QueryError{Op: "Paginate", Reason: "query must not have " + strings.Join(parts, ", ")}
+}
+
+// newSliceElem returns a new element of slice whose element type is elemType, and the pointer to load into it.
+func newSliceElem(elemType reflect.Type) (elem, ptr reflect.Value) {
+	if elemType.Kind() == reflect.Ptr {
+		ptr = reflect.New(elemType.Elem())
+		return ptr, ptr
+	}
+	ptr = reflect.New(elemType)
+	return ptr.Elem(), ptr
+}
+
+// encodePageToken returns the token of pt signed with PageTokenKey and shape.
+// The token is the signature followed by the JSON of pt, in base64url.
+func (gm *Gonm) encodePageToken(pt *pageToken, shape string) (string, error) {
+	payload, err := json.Marshal(pt)
+	if err != nil {
+		return "", err
+	}
+	b := append(gm.signPageToken(payload, shape), payload...)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (gm *Gonm) decodePageToken(token, shape string) (*pageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < sha256.Size {
+		return nil, ErrInvalidPageToken
+	}
+	sig, payload := b[:sha256.Size], b[sha256.Size:]
+	if !hmac.Equal(sig, gm.signPageToken(payload, shape)) {
+		return nil, ErrInvalidPageToken
+	}
+	var pt pageToken
+	if err := json.Unmarshal(payload, &pt); err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	return &pt, nil
+}
+
+func (gm *Gonm) signPageToken(payload []byte, shape string) []byte {
+	mac := hmac.New(sha256.New, gm.PageTokenKey)
+	_, _ = mac.Write([]byte(shape))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// queryShape returns the string which identifies the results of the query of info paginated by pageSize.
+func queryShape(info *backend.QueryDescription, pageSize int) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "kind=%q;ns=%q;", info.Kind, info.Namespace)
+	if info.Ancestor != nil {
+		fmt.Fprintf(&b, "ancestor=%s;", info.Ancestor.Encode())
+	}
+	for _, f := range info.Filters {
+		fmt.Fprintf(&b, "filter=%q %s %s;", f.Property, f.Op, shapeValue(f.Value))
+	}
+	for _, o := range info.Orders {
+		fmt.Fprintf(&b, "order=%q %t;", o.Property, o.Descending)
+	}
+	fmt.Fprintf(&b, "project=%q;keysOnly=%t;size=%d", info.Projection, info.KeysOnly, pageSize)
+	return b.String()
+}
+
+// shapeValue returns the canonical string of a filter value, which does not depend on addresses:
+// keys are encoded, and the other pointers are dereferenced.
+func shapeValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case *datastore.Key:
+		if v == nil {
+			return "key:nil"
+		}
+		return "key:" + v.Encode()
+	case time.Time:
+		return "time:" + v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return "bytes:" + base64.StdEncoding.EncodeToString(v)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return fmt.Sprintf("%T:nil", v)
+		}
+		return "*" + shapeValue(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		elems := make([]string, rv.Len())
+		for i := range elems {
+			elems[i] = shapeValue(rv.Index(i).Interface())
+		}
+		return fmt.Sprintf("%T:[%s]", v, strings.Join(elems, ","))
+	}
+	return fmt.Sprintf("%T:%#v", v, v)
+}
@@ -0,0 +1,123 @@
+package gonm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGonm_Paginate(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+	gm.PageTokenKey = []byte("secret")
+
+	putModel := []*testModel{
+		{ID: 1, Name: "Michael"},
+		{ID: 2, Name: "Tom"},
+		{ID: 3, Name: "Jack"},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	q := gm.Query(&testModel{}).Order("__key__")
+	var first []*testModel
+	page, err := gm.Paginate(q, 2, "", &first)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel[:2], first)
+	assert.True(page.HasMore)
+	assert.Empty(page.PrevToken, "first page")
+
+	var second []*testModel
+	page, err = gm.Paginate(q, 2, page.NextToken, &second)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel[2:], second)
+	assert.False(page.HasMore)
+	assert.Empty(page.NextToken, "last page")
+
+	var prev []*testModel
+	prevPage, err := gm.Paginate(q, 2, page.PrevToken, &prev)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(first, prev, "previous page")
+	assert.Empty(prevPage.PrevToken, "back only one page")
+
+	// the query is built again for every request, so the key of the filter is another pointer
+	keyQuery := func() *Query {
+		return gm.Query(&testModel{}).Filter("__key__ >", datastore.IDKey("testModel", 1, nil)).Order("__key__")
+	}
+	var keyFirst []*testModel
+	page, err = gm.Paginate(keyQuery(), 1, "", &keyFirst)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel[1:2], keyFirst)
+	var keySecond []*testModel
+	if _, err = gm.Paginate(keyQuery(), 1, page.NextToken, &keySecond); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel[2:], keySecond, "token of key filter")
+}
+
+func TestPageToken(t *testing.T) {
+	assert := assert.New(t)
+	gm := &Gonm{PageTokenKey: []byte("secret")}
+	shapeOf := func(q *Query, pageSize int) string {
+		return queryShape(q.query.Description, pageSize)
+	}
+
+	shape := shapeOf(newQuery(&testModel{}).Filter("Name =", "Tom"), 10)
+	token, err := gm.encodePageToken(&pageToken{Cursor: "b", Prev: "a", HasPrev: true}, shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := gm.decodePageToken(token, shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(&pageToken{Cursor: "b", Prev: "a", HasPrev: true}, pt)
+
+	tests := []struct {
+		name  string
+		gm    *Gonm
+		token string
+		shape string
+	}{
+		{"other key", &Gonm{PageTokenKey: []byte("other")}, token, shape},
+		{"tampered", gm, token[:len(token)-2] + "AA", shape},
+		{"other filter", gm, token, shapeOf(newQuery(&testModel{}).Filter("Name =", "Jack"), 10)},
+		{"other page size", gm, token, shapeOf(newQuery(&testModel{}).Filter("Name =", "Tom"), 20)},
+		{"broken", gm, "!", shape},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.gm.decodePageToken(tt.token, tt.shape)
+			assert.Equal(ErrInvalidPageToken, err)
+		})
+	}
+
+	assert.Equal(
+		shapeOf(newQuery(&testModel{}).Filter("__key__ =", datastore.IDKey("p", 1, nil)), 10),
+		shapeOf(newQuery(&testModel{}).Filter("__key__ =", datastore.IDKey("p", 1, nil)).Limit(3), 10),
+		"shape does not depend on key pointer and limit",
+	)
+	now := time.Now()
+	later := now
+	assert.Equal(shapeValue(&now), shapeValue(&later), "shape does not depend on time pointer")
+	assert.Equal(
+		shapeValue([]*datastore.Key{datastore.IDKey("p", 1, nil)}),
+		shapeValue([]*datastore.Key{datastore.IDKey("p", 1, nil)}),
+		"shape does not depend on pointers in slice",
+	)
+	assert.NotEqual(shapeValue(datastore.IDKey("p", 1, nil)), shapeValue(datastore.IDKey("p", 2, nil)))
+}
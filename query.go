@@ -10,28 +10,104 @@ import (
 	"reflect"
 
 	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
 	"google.golang.org/api/iterator"
 )
 
 // Run runs the given query.
-// If Transaction gonm use this method, return ErrInTransaction
-func (gm *Gonm) Run(q *datastore.Query) (*datastore.Iterator, error) {
-	if gm.Transaction != nil {
-		return nil, gm.stackError(ErrInTransaction)
+// If Transaction gonm use this method, q must be an ancestor query.
+// The backends other than Google Cloud Datastore return ErrUnsupported, so use Query.Run for them.
+//
+// Like GetAll, the returned Iterator complements dst of Next with its key.
+func (gm *Gonm) Run(q *datastore.Query) (*Iterator, error) {
+	return gm.run("Run", &backend.Query{Datastore: q}, false)
+}
+
+// RunWithCache is Run of Query which also stores the entities in the cache.
+// The entities of keys-only and projection queries, and of queries in transaction are not stored.
+func (gm *Gonm) RunWithCache(q *Query) (*Iterator, error) {
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, gm.stackError("RunWithCache", nil, err)
+	}
+	return gm.run("RunWithCache", bq, true)
+}
+
+// run runs q on the transaction or the backend of gm.
+// In transaction, the query built by Query must be an ancestor query, or ErrNoAncestor is returned.
+func (gm *Gonm) run(op string, q *backend.Query, cache bool) (*Iterator, error) {
+	if !gm.readTime.IsZero() {
+		return nil, gm.stackError(op, nil, ErrUnsupported)
+	}
+	if gm.tx != nil {
+		if q.Description != nil && q.Description.Ancestor == nil {
+			return nil, gm.stackError(op, nil, ErrNoAncestor)
+		}
+		return &Iterator{gm: gm, it: gm.tx.Run(q)}, nil
+	}
+	if cache && q.Description != nil {
+		cache = !q.Description.KeysOnly && len(q.Description.Projection) == 0
+	}
+	return &Iterator{gm: gm, it: gm.backend.Run(gm.Context, q), cache: cache}, nil
+}
+
+// Iterator is the result of running a query.
+type Iterator struct {
+	gm    *Gonm
+	it    backend.Iterator
+	cache bool
+}
+
+// Next returns the key of the next result. When there are no more results,
+// iterator.Done is returned as the error.
+//
+// If dst is a pointer to a struct, it is complemented with the key.
+func (it *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	key, err := it.it.Next(dst)
+	if err == iterator.Done {
+		return nil, err
+	}
+	if err != nil {
+		return key, it.gm.stackError("Iterator.Next", nil, err)
+	}
+	if dst == nil || reflect.Indirect(reflect.ValueOf(dst)).Kind() != reflect.Struct {
+		return key, nil
+	}
+	if err := setStructKey(dst, key); err != nil {
+		return key, it.gm.stackError("Iterator.Next", []*datastore.Key{key}, err)
+	}
+	if it.cache {
+		// dst is often reused for the next result, so the cache keeps a copy.
+		v := reflect.ValueOf(dst).Elem()
+		cp := reflect.New(v.Type())
+		cp.Elem().Set(v)
+		it.gm.cache.set(key, cp.Interface())
 	}
-	return gm.Client.Run(gm.Context, q), nil
+	return key, nil
+}
+
+// Cursor returns a cursor for the iterator's current location.
+func (it *Iterator) Cursor() (datastore.Cursor, error) {
+	c, err := it.it.Cursor()
+	if err != nil {
+		return c, it.gm.stackError("Iterator.Cursor", nil, err)
+	}
+	return c, nil
 }
 
 // GetAll runs the provided query and returns all keys that match that query,
 // as well as appending the values to dst.
+// If Transaction gonm use this method, q must be an ancestor query.
+// The backends other than Google Cloud Datastore return ErrUnsupported, so use Query.GetAll for them.
 func (gm *Gonm) GetAll(q *datastore.Query, dst interface{}) (keys []*datastore.Key, err error) {
-	if gm.Transaction != nil {
-		return nil, gm.stackError(ErrInTransaction)
-	}
+	return gm.getAll("GetAll", &backend.Query{Datastore: q}, dst)
+}
 
-	keys, err = gm.Client.GetAll(gm.Context, q, dst)
+// getAll runs q and complements the appended structures with their keys.
+func (gm *Gonm) getAll(op string, q *backend.Query, dst interface{}) (keys []*datastore.Key, err error) {
+	keys, err = gm.queryAll(op, q, dst)
 	if err != nil {
-		return nil, gm.stackError(err)
+		return nil, err
 	}
 
 	// query get no much object or keysOnly query
@@ -51,7 +127,77 @@ func (gm *Gonm) GetAll(q *datastore.Query, dst interface{}) (keys []*datastore.K
 			vi = vi.Addr()
 		}
 		if err = setStructKey(vi.Interface(), key); err != nil {
-			return keys, gm.stackError(err)
+			return keys, gm.stackError(op, nil, err)
+		}
+	}
+	return keys, nil
+}
+
+// queryAll runs q on the transaction or the backend of gm.
+func (gm *Gonm) queryAll(op string, q *backend.Query, dst interface{}) (keys []*datastore.Key, err error) {
+	if !gm.readTime.IsZero() {
+		return nil, gm.stackError(op, nil, ErrUnsupported)
+	}
+	if gm.tx != nil {
+		if q.Description != nil && q.Description.Ancestor == nil {
+			return nil, gm.stackError(op, nil, ErrNoAncestor)
+		}
+		keys, err = gm.tx.GetAll(q, dst)
+	} else {
+		keys, err = gm.backend.GetAll(gm.Context, q, dst)
+	}
+	if err != nil {
+		return nil, gm.stackError(op, nil, err)
+	}
+	return keys, nil
+}
+
+// GetProjection runs the projection query q and appends the entities to dst.
+//
+// Dst must be a pointer to a slice of a struct or of pointers to a struct, which may have only the projected fields.
+// If the struct does not have a projected property, *PropertyError is returned.
+// The appended structures are complemented with their keys if the struct has ID field,
+// and they are never stored in the cache because they are partial entities.
+func (gm *Gonm) GetProjection(q *Query, dst interface{}) ([]*datastore.Key, error) {
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, gm.stackError("GetProjection", nil, err)
+	}
+	projection := bq.Description.Projection
+	if len(projection) == 0 {
+		return nil, gm.stackError("GetProjection", nil, ErrNoProjection)
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return nil, gm.stackError("GetProjection", nil, invalidType(dst, "pointer to a slice of structs"))
+	}
+	sv := v.Elem()
+	t := sv.Type().Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, gm.stackError("GetProjection", nil, invalidType(dst, "pointer to a slice of structs"))
+	}
+	props := structProperties(t)
+	for _, name := range projection {
+		if !props[name] {
+			return nil, gm.stackError("GetProjection", nil, &PropertyError{Type: t, Property: name})
+		}
+	}
+
+	before := sv.Len()
+	keys, err := gm.queryAll("GetProjection", bq, dst)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		vi := sv.Index(before + i)
+		if vi.Kind() == reflect.Struct {
+			vi = vi.Addr()
+		}
+		if err := setStructKey(vi.Interface(), key); err != nil && err != ErrNoIDField {
+			return keys, gm.stackError("GetProjection", []*datastore.Key{key}, err)
 		}
 	}
 	return keys, nil
@@ -60,26 +206,84 @@ func (gm *Gonm) GetAll(q *datastore.Query, dst interface{}) (keys []*datastore.K
 // GetKeysOnly run q.KeysOnly().
 //
 // this method return key and cursor. That`s why assuming that combining this method with GetByKey,
+// If Transaction gonm use this method, q must be an ancestor query.
+// The backends other than Google Cloud Datastore return ErrUnsupported, so use Query.GetKeysOnly for them.
 func (gm *Gonm) GetKeysOnly(q *datastore.Query) (keys []*datastore.Key, cursor datastore.Cursor, err error) {
-	if gm.Transaction != nil {
-		return nil, datastore.Cursor{}, gm.stackError(ErrInTransaction)
-	}
+	return gm.getKeysOnly("GetKeysOnly", &backend.Query{Datastore: q})
+}
 
-	t := gm.Client.Run(gm.Context, q.KeysOnly())
+// getKeysOnly runs q as keys-only query and returns the keys and the cursor after them.
+func (gm *Gonm) getKeysOnly(op string, q *backend.Query) (keys []*datastore.Key, cursor datastore.Cursor, err error) {
+	it, err := gm.run(op, q.KeysOnly(), false)
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
 	for {
-		key, err := t.Next(nil)
+		key, err := it.it.Next(nil)
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return keys, datastore.Cursor{}, gm.stackError(err)
+			return keys, datastore.Cursor{}, gm.stackError(op, nil, err)
 		}
 		keys = append(keys, key)
 	}
 
-	cursor, err = t.Cursor()
+	cursor, err = it.it.Cursor()
 	if err != nil {
-		return keys, cursor, gm.stackError(err)
+		return keys, cursor, gm.stackError(op, nil, err)
 	}
 	return keys, cursor, nil
 }
+
+// GetAllCached runs q as keys-only query and appends the entities of the keys to dst.
+//
+// This method combines GetKeysOnly with GetMultiByKeys. The entities in the cache are served from it,
+// and only the others are fetched in parallel batches and stored in the cache.
+// Keys of entities deleted after the query are left out of keys and dst.
+// All appended structures are complemented with their keys.
+func (gm *Gonm) GetAllCached(q *Query, dst interface{}) (keys []*datastore.Key, cursor datastore.Cursor, err error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return nil, cursor, gm.stackError("GetAllCached", nil, invalidType(dst, "pointer to a slice"))
+	}
+	sv := v.Elem()
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, cursor, gm.stackError("GetAllCached", nil, err)
+	}
+
+	keys, cursor, err = gm.getKeysOnly("GetAllCached", bq)
+	if err != nil || len(keys) == 0 {
+		return nil, cursor, err
+	}
+
+	elemType := sv.Type().Elem()
+	loaded := reflect.MakeSlice(sv.Type(), len(keys), len(keys))
+	if elemType.Kind() == reflect.Ptr {
+		for i := range keys {
+			loaded.Index(i).Set(reflect.New(elemType.Elem()))
+		}
+	}
+	found, err := gm.GetMultiByKeysPartial(keys, loaded.Interface())
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	var ret []*datastore.Key
+	for i, key := range keys {
+		if !found[i] {
+			continue
+		}
+		vi := loaded.Index(i)
+		if vi.Kind() == reflect.Struct {
+			vi = vi.Addr()
+		}
+		if err := setStructKey(vi.Interface(), key); err != nil {
+			return nil, cursor, gm.stackError("GetAllCached", []*datastore.Key{key}, err)
+		}
+		sv.Set(reflect.Append(sv, loaded.Index(i)))
+		ret = append(ret, key)
+	}
+	return ret, cursor, nil
+}
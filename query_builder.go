@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for query builder
+ */
+
+package gonm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+)
+
+// Query is a query of the kind of a struct.
+//
+// Query derives the kind from the struct by KindWithTag, and validates property names
+// against the datastore fields of the struct.
+// Like datastore.Query, every method returns a derivative query, and the first error is returned when the query runs.
+//
+// Query records its content as well as building datastore.Query,
+// so the queries of Query run on every Backend of Gonm.
+type Query struct {
+	gm    *Gonm
+	typ   reflect.Type
+	query *backend.Query
+	err   error
+}
+
+// Query creates a new Query for the kind of src.
+func (gm *Gonm) Query(src interface{}) *Query {
+	q := newQuery(src)
+	q.gm = gm
+	return q
+}
+
+func newQuery(src interface{}) *Query {
+	t := reflect.TypeOf(src)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return &Query{err: invalidType(src, "pointer to a struct")}
+	}
+	kind, err := KindWithTag(src)
+	if err != nil {
+		return &Query{typ: t.Elem(), err: err}
+	}
+	return &Query{typ: t.Elem(), query: &backend.Query{
+		Datastore:   datastore.NewQuery(kind),
+		Description: &backend.QueryDescription{Kind: kind, Limit: -1},
+	}}
+}
+
+func (q *Query) clone() *Query {
+	ret := *q
+	return &ret
+}
+
+// derive returns a derivative query whose datastore.Query is f(q.query.Datastore)
+// and whose description is updated by g.
+func (q *Query) derive(f func(*datastore.Query) *datastore.Query, g func(*backend.QueryDescription)) *Query {
+	if q.err != nil {
+		return q
+	}
+	desc := q.query.Description.Clone()
+	g(desc)
+	ret := q.clone()
+	ret.query = &backend.Query{Datastore: f(q.query.Datastore), Description: desc}
+	return ret
+}
+
+// fail returns a derivative query which returns err.
+func (q *Query) fail(err error) *Query {
+	ret := q.clone()
+	ret.err = err
+	return ret
+}
+
+// Ancestor returns a derivative query with an ancestor filter.
+// The key of ancestor is generated from the struct.
+func (q *Query) Ancestor(ancestor interface{}) *Query {
+	if q.err != nil {
+		return q
+	}
+	key, err := getStructKey(ancestor)
+	if err == nil && key.Incomplete() {
+		err = &KeyError{Type: reflect.TypeOf(ancestor), Key: key, Err: ErrIncompleteKey}
+	}
+	if err != nil {
+		return q.fail(err)
+	}
+	return q.AncestorKey(key)
+}
+
+// AncestorKey returns a derivative query with an ancestor filter by key.
+func (q *Query) AncestorKey(key *datastore.Key) *Query {
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Ancestor(key) },
+		func(d *backend.QueryDescription) { d.Ancestor = key },
+	)
+}
+
+// Filter returns a derivative query with a field-based filter.
+// FilterStr is parsed in the same way as datastore.Query.Filter, and *QueryError is returned if it is invalid.
+// If the struct does not have the property, the query returns *PropertyError.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	if q.err != nil {
+		return q
+	}
+	f, err := parseFilter(filterStr, value)
+	if err == nil {
+		err = q.checkProperty(f.Property)
+	}
+	if err != nil {
+		return q.fail(err)
+	}
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Filter(filterStr, value) },
+		func(d *backend.QueryDescription) { d.Filters = append(d.Filters, f) },
+	)
+}
+
+// Order returns a derivative query with a field-based sort order.
+// FieldName is parsed in the same way as datastore.Query.Order, and *QueryError is returned if it is invalid.
+// If the struct does not have the property, the query returns *PropertyError.
+func (q *Query) Order(fieldName string) *Query {
+	if q.err != nil {
+		return q
+	}
+	o, err := parseOrder(fieldName)
+	if err == nil {
+		err = q.checkProperty(o.Property)
+	}
+	if err != nil {
+		return q.fail(err)
+	}
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Order(fieldName) },
+		func(d *backend.QueryDescription) { d.Orders = append(d.Orders, o) },
+	)
+}
+
+// Project returns a derivative query that yields only the given fields.
+// If the struct does not have the property, the query returns *PropertyError.
+func (q *Query) Project(fieldNames ...string) *Query {
+	if q.err != nil {
+		return q
+	}
+	for _, name := range fieldNames {
+		if err := q.checkProperty(name); err != nil {
+			return q.fail(err)
+		}
+	}
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Project(fieldNames...) },
+		func(d *backend.QueryDescription) { d.Projection = append([]string(nil), fieldNames...) },
+	)
+}
+
+// Namespace returns a derivative query that is associated with the given namespace.
+func (q *Query) Namespace(ns string) *Query {
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Namespace(ns) },
+		func(d *backend.QueryDescription) { d.Namespace = ns },
+	)
+}
+
+// Limit returns a derivative query that has a limit on the number of results returned.
+// A negative value means unlimited.
+func (q *Query) Limit(limit int) *Query {
+	if q.err == nil && (limit < math.MinInt32 || limit > math.MaxInt32) {
+		return q.fail(&QueryError{Op: "Limit", Reason: "limit overflow"})
+	}
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Limit(limit) },
+		func(d *backend.QueryDescription) { d.Limit = int32(limit) },
+	)
+}
+
+// Offset returns a derivative query that has an offset of how many keys to skip over before returning results.
+func (q *Query) Offset(offset int) *Query {
+	if q.err == nil && (offset < 0 || offset > math.MaxInt32) {
+		return q.fail(&QueryError{Op: "Offset", Reason: fmt.Sprintf("invalid offset %d", offset)})
+	}
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Offset(offset) },
+		func(d *backend.QueryDescription) { d.Offset = int32(offset) },
+	)
+}
+
+// Start returns a derivative query with the given start point.
+func (q *Query) Start(c datastore.Cursor) *Query {
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.Start(c) },
+		func(d *backend.QueryDescription) { d.Start = c },
+	)
+}
+
+// End returns a derivative query with the given end point.
+func (q *Query) End(c datastore.Cursor) *Query {
+	return q.derive(
+		func(dq *datastore.Query) *datastore.Query { return dq.End(c) },
+		func(d *backend.QueryDescription) { d.End = c },
+	)
+}
+
+// Err returns the first error occurred while building the query.
+func (q *Query) Err() error {
+	return q.err
+}
+
+// DatastoreQuery returns datastore.Query built by q.
+func (q *Query) DatastoreQuery() (*datastore.Query, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	return q.query.Datastore, nil
+}
+
+// backendQuery returns the query run on Backend, or the first error occurred while building q.
+func (q *Query) backendQuery() (*backend.Query, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	return q.query, nil
+}
+
+// Run runs the query by Gonm.Run.
+func (q *Query) Run() (*Iterator, error) {
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, q.gm.stackError("Query.Run", nil, err)
+	}
+	return q.gm.run("Query.Run", bq, false)
+}
+
+// GetAll runs the query by Gonm.GetAll and appends the entities to dst.
+// dst must be a pointer to a slice of the struct or of pointers to the struct.
+func (q *Query) GetAll(dst interface{}) ([]*datastore.Key, error) {
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, q.gm.stackError("Query.GetAll", nil, err)
+	}
+	if !q.isDestination(dst) {
+		return nil, q.gm.stackError("Query.GetAll", nil, invalidType(dst, "pointer to a slice of "+q.typ.String()))
+	}
+	return q.gm.getAll("Query.GetAll", bq, dst)
+}
+
+// GetKeysOnly runs the query by Gonm.GetKeysOnly.
+func (q *Query) GetKeysOnly() ([]*datastore.Key, datastore.Cursor, error) {
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, datastore.Cursor{}, q.gm.stackError("Query.GetKeysOnly", nil, err)
+	}
+	return q.gm.getKeysOnly("Query.GetKeysOnly", bq)
+}
+
+// parseFilter parses filterStr in the same way as datastore.Query.Filter.
+func parseFilter(filterStr string, value interface{}) (backend.QueryFilter, error) {
+	s := strings.TrimSpace(filterStr)
+	f := backend.QueryFilter{Property: strings.TrimRight(s, " ><=!"), Value: value}
+	switch f.Op = strings.TrimSpace(s[len(f.Property):]); f.Op {
+	case "<", "<=", "=", ">=", ">":
+	default:
+		return f, &QueryError{Op: "Filter", Reason: fmt.Sprintf("invalid operator %q in filter %q", f.Op, filterStr)}
+	}
+	property, err := unquoteProperty(f.Property)
+	if err != nil {
+		return f, &QueryError{Op: "Filter", Reason: fmt.Sprintf("invalid quoted property %s", f.Property)}
+	}
+	f.Property = property
+	return f, nil
+}
+
+// parseOrder parses fieldName in the same way as datastore.Query.Order.
+func parseOrder(fieldName string) (backend.QueryOrder, error) {
+	var o backend.QueryOrder
+	name := strings.TrimSpace(fieldName)
+	if strings.HasPrefix(name, "-") {
+		name, o.Descending = strings.TrimSpace(name[1:]), true
+	} else if strings.HasPrefix(name, "+") {
+		return o, &QueryError{Op: "Order", Reason: fmt.Sprintf("invalid order %q", fieldName)}
+	}
+	property, err := unquoteProperty(name)
+	if err != nil || property == "" {
+		return o, &QueryError{Op: "Order", Reason: fmt.Sprintf("invalid order %q", fieldName)}
+	}
+	o.Property = property
+	return o, nil
+}
+
+func unquoteProperty(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
+func (q *Query) isDestination(dst interface{}) bool {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return false
+	}
+	elem := v.Elem().Type().Elem()
+	return elem == q.typ || (elem.Kind() == reflect.Ptr && elem.Elem() == q.typ)
+}
+
+func (q *Query) checkProperty(name string) error {
+	if name == keyPropertyName || structProperties(q.typ)[name] {
+		return nil
+	}
+	return &PropertyError{Type: q.typ, Property: name}
+}
+
+// keyPropertyName is the property name of the key of entity.
+const keyPropertyName = "__key__"
+
+var (
+	typeOfTime     = reflect.TypeOf(time.Time{})
+	typeOfGeoPoint = reflect.TypeOf(datastore.GeoPoint{})
+	typeOfKey      = reflect.TypeOf(datastore.Key{})
+
+	propertiesCache sync.Map
+)
+
+// structProperties returns the property names of the datastore fields of struct type t.
+// The properties of nested structs are named like "Outer.Inner".
+func structProperties(t reflect.Type) map[string]bool {
+	if props, ok := propertiesCache.Load(t); ok {
+		return props.(map[string]bool)
+	}
+	props := make(map[string]bool)
+	addStructProperties(props, t, "", make(map[reflect.Type]bool))
+	propertiesCache.Store(t, props)
+	return props
+}
+
+func addStructProperties(props map[string]bool, t reflect.Type, prefix string, visiting map[reflect.Type]bool) {
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("datastore"), ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			addStructProperties(props, ft, prefix, visiting)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[prefix+name] = true
+
+		if ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8 {
+			ft = ft.Elem()
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+		}
+		if ft.Kind() == reflect.Struct && ft != typeOfTime && ft != typeOfGeoPoint && ft != typeOfKey {
+			addStructProperties(props, ft, prefix+name+".", visiting)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package gonm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGonm_Query(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	gm := newTestGonm(ctx)
+
+	parent := &testModel{ID: 100, Name: "parent"}
+	putModel := []*testModel2{
+		{IDOther: 1, Name: "Michael", Parent: datastore.IDKey("testModel", parent.ID, nil)},
+		{IDOther: 2, Name: "Tom", Parent: datastore.IDKey("testModel", parent.ID, nil)},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	var getModel []*testModel2
+	keys, err := gm.Query(&testModel2{}).Ancestor(parent).Filter("Name =", "Tom").GetAll(&getModel)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Len(keys, 1)
+	assert.Equal("test", keys[0].Kind, "kind from tag")
+	assert.Equal(int64(2), getModel[0].IDOther, "set struct key")
+
+	_, err = gm.Query(&testModel2{}).Filter("Age >", 1).GetAll(&getModel)
+	var perr *PropertyError
+	assert.True(errors.As(err, &perr), "unknown property")
+	assert.Equal("Age", perr.Property)
+
+	_, err = gm.Query(&testModel2{}).Ancestor(&testModel{}).GetAll(&getModel)
+	assert.True(errors.Is(err, ErrIncompleteKey), "incomplete ancestor")
+
+	_, err = gm.Query(&testModel2{}).GetAll(&[]*testModel{})
+	assert.True(errors.Is(err, ErrInvalidDestination), "other struct")
+}
+
+func TestStructProperties(t *testing.T) {
+	type inner struct {
+		Value string `datastore:"value"`
+	}
+	type Embedded struct {
+		Embed string
+	}
+	type model struct {
+		ID int64 `datastore:"-"`
+		Embedded
+		Name      string `datastore:"name,noindex"`
+		Inner     inner
+		Inners    []*inner
+		CreatedAt time.Time
+		Key       *datastore.Key
+		Bytes     []byte
+		private   string
+	}
+
+	props := structProperties(reflect.TypeOf(model{}))
+	assert.Equal(t, map[string]bool{
+		"Embed":        true,
+		"name":         true,
+		"Inner":        true,
+		"Inner.value":  true,
+		"Inners":       true,
+		"Inners.value": true,
+		"CreatedAt":    true,
+		"Key":          true,
+		"Bytes":        true,
+	}, props)
+}
+
+func TestQueryDescription(t *testing.T) {
+	assert := assert.New(t)
+
+	parent := datastore.IDKey("testModel", 1, nil)
+	q := newQuery(&testModel{}).AncestorKey(parent).Filter(" Name >= ", "a").Filter(`"__key__" <`, parent).
+		Order("-Name").Order("__key__").Project("Name").Namespace("ns").Limit(10).Offset(2)
+	bq, err := q.backendQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(&backend.QueryDescription{
+		Kind:      "testModel",
+		Namespace: "ns",
+		Ancestor:  parent,
+		Filters: []backend.QueryFilter{
+			{Property: "Name", Op: ">=", Value: "a"},
+			{Property: "__key__", Op: "<", Value: parent},
+		},
+		Orders:     []backend.QueryOrder{{Property: "Name", Descending: true}, {Property: "__key__"}},
+		Projection: []string{"Name"},
+		Limit:      10,
+		Offset:     2,
+	}, bq.Description)
+	assert.Equal(int32(-1), newQuery(&testModel{}).query.Description.Limit, "no limit")
+
+	derived := q.Filter("Name =", "b")
+	assert.Len(q.query.Description.Filters, 2, "derivative query does not change q")
+	assert.Len(derived.query.Description.Filters, 3)
+
+	tests := []struct {
+		name string
+		q    *Query
+		op   string
+	}{
+		{"invalid operator", newQuery(&testModel{}).Filter("Name !=", "a"), "Filter"},
+		{"no operator", newQuery(&testModel{}).Filter("Name", "a"), "Filter"},
+		{"plus order", newQuery(&testModel{}).Order("+Name"), "Order"},
+		{"empty order", newQuery(&testModel{}).Order("-"), "Order"},
+		{"negative offset", newQuery(&testModel{}).Offset(-1), "Offset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var qerr *QueryError
+			if assert.True(errors.As(tt.q.Err(), &qerr)) {
+				assert.Equal(tt.op, qerr.Op)
+			}
+			assert.True(errors.Is(tt.q.Err(), ErrInvalidQuery))
+		})
+	}
+}
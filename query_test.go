@@ -2,11 +2,13 @@ package gonm
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
 )
 
 func TestGonm_GetAll(t *testing.T) {
@@ -14,7 +16,7 @@ func TestGonm_GetAll(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	putModel := []*testModel{
 		{ID: 1, Name: "Michael"},
@@ -39,7 +41,7 @@ func TestGonm_GetKeysOnly(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	putModel := []*testModel{
 		{ID: 1, Name: "Michael"},
@@ -88,3 +90,126 @@ func TestGonm_GetKeysOnly(t *testing.T) {
 	}
 	assert.Equal(t, secondDst, thirdDst, "GetKeysOnly cursor set end")
 }
+
+func TestGonm_Run(t *testing.T) {
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := []*testModel{
+		{ID: 1, Name: "Michael"},
+		{ID: 2, Name: "Tom"},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	gm.CacheClear()
+
+	it, err := gm.RunWithCache(gm.Query(&testModel{}).Order("__key__").Limit(2))
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	var getModel testModel
+	for _, want := range putModel {
+		if _, err := it.Next(&getModel); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal(t, *want, getModel, "Run and complete ID")
+	}
+	_, err = it.Next(&getModel)
+	assert.Equal(t, iterator.Done, err)
+
+	_, ok := gm.cache.get(datastore.IDKey(Kind(testModel{}), 1, nil))
+	assert.True(t, ok, "RunWithCache set cache")
+	cached := &testModel{ID: 1}
+	if err := gm.Get(cached); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(t, putModel[0], cached, "cache is not changed by reusing dst")
+}
+
+func TestGonm_GetAllCached(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := []*testModel{
+		{ID: 1, Name: "Michael"},
+		{ID: 2, Name: "Tom"},
+		{ID: 3, Name: "Jack"},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	gm.CacheClear()
+	if err := gm.Get(&testModel{ID: 1}); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	q := gm.Query(&testModel{}).Order("__key__").Limit(2)
+	var getModel []*testModel
+	keys, cursor, err := gm.GetAllCached(q, &getModel)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Len(keys, 2)
+	assert.Equal(putModel[:2], getModel, "GetAllCached and complete ID")
+	_, ok := gm.cache.get(keys[1])
+	assert.True(ok, "GetAllCached set cache")
+
+	var nextModel []testModel
+	if _, _, err := gm.GetAllCached(q.Start(cursor), &nextModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]testModel{*putModel[2]}, nextModel, "GetAllCached cursor")
+}
+
+type testProjectionModel struct {
+	ID    int64 `datastore:"-"`
+	Group string
+	Age   int64
+}
+
+func TestGonm_GetProjection(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := []*testProjectionModel{
+		{ID: 1, Group: "a", Age: 10},
+		{ID: 2, Group: "b", Age: 20},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	gm.CacheClear()
+
+	q := gm.Query(&testProjectionModel{}).Project("Group").Order("Group")
+	var getModel []*testProjectionModel
+	keys, err := gm.GetProjection(q, &getModel)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Len(keys, 2)
+	assert.Equal([]*testProjectionModel{{ID: 1, Group: "a"}, {ID: 2, Group: "b"}}, getModel, "GetProjection and complete ID")
+	_, ok := gm.cache.get(keys[0])
+	assert.False(ok, "GetProjection does not set cache")
+
+	type groupOnly struct {
+		Group string
+	}
+	var groups []groupOnly
+	if _, err := gm.GetProjection(q, &groups); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]groupOnly{{Group: "a"}, {Group: "b"}}, groups, "struct without ID field")
+
+	var unknown []testModel
+	_, err = gm.GetProjection(gm.Query(&testProjectionModel{}).Project("Age"), &unknown)
+	assert.Equal(&PropertyError{Type: reflect.TypeOf(testModel{}), Property: "Age"}, err)
+
+	_, err = gm.GetProjection(gm.Query(&testProjectionModel{}), &getModel)
+	assert.Equal(ErrNoProjection, err)
+}
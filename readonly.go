@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for read-only transaction and reads at a time
+ */
+
+package gonm
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// RunInReadOnlyTransaction runs f in a read-only transaction, which reads a consistent snapshot of entities.
+//
+// The methods which write entities return ErrReadOnly without calling the Backend.
+// The reads in the transaction neither use, store nor invalidate the cache.
+// OnCommit hooks are called after the transaction ends without error.
+func (gm *Gonm) RunInReadOnlyTransaction(f func(gm *Gonm) error, otps ...datastore.TransactionOption) error {
+	_, err := gm.RunInTransaction(f, append(otps, datastore.ReadOnly)...)
+	return err
+}
+
+// ReadAt returns Gonm which reads entities as they were at t.
+//
+// On Google Cloud Datastore, Gonm of ReadAt reads entities by keys in read-only transactions at t,
+// so the reads of GetMulti calls are a consistent snapshot as of t.
+// Snapshot reads skip the cache: they neither use, store nor invalidate it.
+// The methods which write entities return ErrReadOnly, and queries and transactions return ErrUnsupported.
+// gonmtest and gonmfile keep no history of entities, so their reads return ErrUnsupported.
+//
+// ReadAt panics if gm is in transaction or t is zero.
+func (gm *Gonm) ReadAt(t time.Time) *Gonm {
+	if gm.tx != nil {
+		panic("gonm: ReadAt is called in transaction")
+	}
+	if t.IsZero() {
+		panic("gonm: zero read time")
+	}
+	gmat := gm.WithContext(gm.Context)
+	gmat.readOnly = true
+	gmat.readTime = t
+	return gmat
+}
@@ -0,0 +1,126 @@
+package gonm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/komem3/gonm/internal/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// readTimeBackend returns the entities of the version of the read time by GetMultiAt.
+type readTimeBackend struct {
+	backend.Backend
+	versions map[int64][]testModel
+}
+
+func (b *readTimeBackend) GetMultiAt(ctx context.Context, readTime time.Time, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	merr := make(datastore.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		var found *testModel
+		for _, m := range b.versions[readTime.Unix()] {
+			if m.ID == key.ID {
+				m := m
+				found = &m
+			}
+		}
+		if found == nil {
+			merr[i] = datastore.ErrNoSuchEntity
+			hasErr = true
+			continue
+		}
+		reflect.Indirect(v.Index(i).Elem()).Set(reflect.ValueOf(*found))
+	}
+	if hasErr {
+		return merr
+	}
+	return nil
+}
+
+func TestGonm_ReadAt(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := fromBackend(ctx, &readTimeBackend{
+		Backend: memstore.New(memstore.Options{}),
+		versions: map[int64][]testModel{
+			1: {{Name: "Michael", ID: 1}},
+			2: {{Name: "Tom", ID: 1}, {Name: "Jack", ID: 2}},
+		},
+	})
+	if _, err := gm.Put(&testModel{ID: 1, Name: "Bob"}); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	key := datastore.IDKey(Kind(testModel{}), 1, nil)
+	if _, ok := gm.cache.get(key); !ok {
+		t.Fatal("put does not store cache")
+	}
+
+	getModel := []*testModel{{ID: 1}, {ID: 2}}
+	gmat := gm.ReadAt(time.Unix(2, 0))
+	if err := gmat.GetMulti(getModel); err != nil {
+		t.Fatal(gmat.printStackErrs(err))
+	}
+	assert.Equal([]*testModel{{ID: 1, Name: "Tom"}, {ID: 2, Name: "Jack"}}, getModel, "skip cache")
+
+	getModel = []*testModel{{ID: 1}}
+	if err := gm.ReadAt(time.Unix(1, 0)).GetMulti(getModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal("Michael", getModel[0].Name, "read as of the time")
+	cached, _ := gm.cache.get(key)
+	assert.Equal(&testModel{ID: 1, Name: "Bob"}, cached, "ReadAt does not store cache")
+
+	_, err := gmat.Put(&testModel{ID: 1})
+	assert.Equal(ErrReadOnly, err)
+	assert.Equal(ErrReadOnly, gmat.Delete(&testModel{ID: 1}))
+	_, err = gmat.Mutate(NewUpsert(&testModel{ID: 1}))
+	assert.Equal(ErrReadOnly, err)
+	_, _, err = gmat.Query(&testModel{}).GetKeysOnly()
+	assert.Equal(ErrUnsupported, err)
+	_, err = gmat.RunInTransaction(func(*Gonm) error { return nil })
+	assert.Equal(ErrUnsupported, err)
+
+	gm = fromBackend(ctx, memstore.New(memstore.Options{}))
+	assert.Equal(ErrUnsupported, gm.ReadAt(time.Unix(1, 0)).Get(&testModel{ID: 1}), "no history")
+}
+
+func TestGonm_RunInReadOnlyTransaction(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := &testModel{ID: 1, Name: "Michael"}
+	if _, err := gm.Put(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	key, err := getStructKey(putModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gm.RunInReadOnlyTransaction(func(tx *Gonm) error {
+		getModel := &testModel{ID: 1}
+		if err := tx.Get(getModel); err != nil {
+			return err
+		}
+		assert.Equal(putModel, getModel)
+
+		_, err := tx.Put(getModel)
+		assert.Equal(ErrReadOnly, err, "bypass write path")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	cached, ok := gm.cache.get(key)
+	assert.True(ok, "read-only transaction does not invalidate cache")
+	assert.Equal(putModel, cached)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for generic repository
+ */
+
+package gonm
+
+import (
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KeyID is the type of ID field of a structure.
+type KeyID interface {
+	~int64 | ~string
+}
+
+// Repo is a type-safe repository of T built on Gonm.
+//
+// T is a structure that Gonm can generate key from, and ID is the type of its ID field.
+//
+//	users := gonm.NewRepo[User, int64](gm)
+//	user, err := users.Get(ctx, 1)
+type Repo[T any, ID KeyID] struct {
+	gm *Gonm
+}
+
+// NewRepo generate Repo of T from gm.
+func NewRepo[T any, ID KeyID](gm *Gonm) *Repo[T, ID] {
+	return &Repo[T, ID]{gm: gm}
+}
+
+// Gonm returns Gonm used by r.
+func (r *Repo[T, ID]) Gonm() *Gonm {
+	return r.gm
+}
+
+// Key generate *datastore.Key of T from id.
+func (r *Repo[T, ID]) Key(id ID, parent *datastore.Key) (*datastore.Key, error) {
+	kind, err := KindWithTag(new(T))
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(id)
+	if v.Kind() == reflect.String {
+		return datastore.NameKey(kind, v.String(), parent), nil
+	}
+	return datastore.IDKey(kind, v.Int(), parent), nil
+}
+
+// Get loads T of id.
+//
+// If there is no such entity for the id, Get returns datastore.ErrNoSuchEntity.
+func (r *Repo[T, ID]) Get(ctx context.Context, id ID) (*T, error) {
+	key, err := r.Key(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetByKey(ctx, key)
+}
+
+// GetByKey loads T of key.
+func (r *Repo[T, ID]) GetByKey(ctx context.Context, key *datastore.Key) (*T, error) {
+	dst := new(T)
+	if err := setStructKey(dst, key); err != nil {
+		return nil, err
+	}
+	if err := r.gm.WithContext(ctx).GetByKey(key, dst); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// GetMulti is a batch version of Get.
+//
+// The returned slice has the same length as ids.
+// If there are errors, GetMulti returns datastore.MultiError whose entry i corresponds to ids[i].
+func (r *Repo[T, ID]) GetMulti(ctx context.Context, ids []ID) ([]*T, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		key, err := r.Key(id, nil)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return r.GetMultiByKeys(ctx, keys)
+}
+
+// GetMultiByKeys is a batch version of GetByKey.
+func (r *Repo[T, ID]) GetMultiByKeys(ctx context.Context, keys []*datastore.Key) ([]*T, error) {
+	dst := make([]*T, len(keys))
+	for i, key := range keys {
+		dst[i] = new(T)
+		if err := setStructKey(dst[i], key); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.gm.WithContext(ctx).GetMultiByKeys(keys, dst); err != nil {
+		return dst, err
+	}
+	return dst, nil
+}
+
+// Put saves src and complements src with ID.
+func (r *Repo[T, ID]) Put(ctx context.Context, src *T) (*datastore.Key, error) {
+	return r.gm.WithContext(ctx).Put(src)
+}
+
+// PutMulti is a batch version of Put.
+func (r *Repo[T, ID]) PutMulti(ctx context.Context, src []*T) ([]*datastore.Key, error) {
+	return r.gm.WithContext(ctx).PutMulti(src)
+}
+
+// Delete deletes the entity of src.
+func (r *Repo[T, ID]) Delete(ctx context.Context, src *T) error {
+	return r.gm.WithContext(ctx).Delete(src)
+}
+
+// DeleteMulti is a batch version of Delete.
+func (r *Repo[T, ID]) DeleteMulti(ctx context.Context, src []*T) error {
+	return r.gm.WithContext(ctx).DeleteMulti(src)
+}
+
+// NewQuery creates a new Query for the kind of T.
+func (r *Repo[T, ID]) NewQuery() *Query {
+	return newQuery(new(T))
+}
+
+// Query runs q and returns all entities that match q.
+// All returned structures are complemented with their keys.
+func (r *Repo[T, ID]) Query(ctx context.Context, q *Query) ([]*T, error) {
+	gm := r.gm.WithContext(ctx)
+	bq, err := q.backendQuery()
+	if err != nil {
+		return nil, gm.stackError("Repo.Query", nil, err)
+	}
+	var dst []*T
+	if _, err := gm.getAll("Repo.Query", bq, &dst); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
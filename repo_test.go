@@ -0,0 +1,70 @@
+package gonm
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type testNameModel struct {
+	Code string `datastore:"-" gonm:"id"`
+	Name string
+}
+
+func TestRepo(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	gm := newTestGonm(ctx)
+
+	t.Run("int64 id", func(t *testing.T) {
+		repo := NewRepo[testModel, int64](gm)
+		keys, err := repo.PutMulti(ctx, []*testModel{{ID: 1, Name: "Michael"}, {ID: 2, Name: "Tom"}})
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Len(keys, 2)
+
+		user, err := repo.Get(ctx, 1)
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal(&testModel{ID: 1, Name: "Michael"}, user)
+
+		users, err := repo.GetMulti(ctx, []int64{2, 999999})
+		merr, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("error is not MultiError")
+		}
+		assert.NoError(merr[0])
+		assert.Equal(datastore.ErrNoSuchEntity, merr[1])
+		assert.Equal("Tom", users[0].Name)
+
+		users, err = repo.Query(ctx, repo.NewQuery().Filter("Name =", "Tom"))
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		if assert.Len(users, 1) {
+			assert.Equal(int64(2), users[0].ID, "complemented with key")
+		}
+	})
+
+	t.Run("string id", func(t *testing.T) {
+		repo := NewRepo[testNameModel, string](gm)
+		if _, err := repo.Put(ctx, &testNameModel{Code: "a", Name: "Hanako"}); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		model, err := repo.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal(&testNameModel{Code: "a", Name: "Hanako"}, model)
+
+		if err := repo.Delete(ctx, model); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		_, err = repo.Get(ctx, "a")
+		assert.Equal(datastore.ErrNoSuchEntity, err)
+	})
+}
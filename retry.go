@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for retry policy of transaction
+ */
+
+package gonm
+
+import (
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+)
+
+// DefaultMaxAttempts is the number of attempts of RetryPolicy by default, which is the same as datastore.
+const DefaultMaxAttempts = 3
+
+// RetryPolicy decides how RunInTransaction retries a failed transaction.
+//
+// Each attempt runs in a new transaction. The structures put and the cache invalidations of a failed attempt
+// are discarded, so only the committed attempt complements keys and invalidates the cache.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts. If MaxAttempts is 0, DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the second attempt.
+	// The wait is multiplied by Multiplier for each attempt, and it is limited to MaxBackoff if MaxBackoff is not 0.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Multiplier is the growth of the wait. If Multiplier is less than 1, 2 is used.
+	Multiplier float64
+	// Jitter is the fraction of the wait which is randomized, between 0 and 1.
+	Jitter float64
+
+	// Retryable reports whether the attempt that failed with err should be retried.
+	// If Retryable is nil, only datastore.ErrConcurrentTransaction is retried.
+	Retryable func(err error) bool
+
+	// OnAttempt is called after each attempt with the attempt number starting from 1 and its error.
+	// The error is nil when the attempt is committed.
+	OnAttempt func(attempt int, err error)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return err == datastore.ErrConcurrentTransaction
+	}
+	return p.Retryable(err)
+}
+
+// backoff returns the wait after the attempt-th attempt failed. r returns a random number in [0, 1).
+func (p *RetryPolicy) backoff(attempt int, r func() float64) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	wait := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		wait *= multiplier
+		if p.MaxBackoff > 0 && wait >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		wait -= wait * jitter * r()
+	}
+	return time.Duration(wait)
+}
+
+// runWithRetryPolicy runs f in transactions according to gm.RetryPolicy.
+func (gm *Gonm) runWithRetryPolicy(f func(gm *Gonm) error, opts []datastore.TransactionOption) (*Gonm, backend.Commit, error) {
+	policy := gm.RetryPolicy
+	var err error
+	for attempt := 1; ; attempt++ {
+		var (
+			gmtx *Gonm
+			c    backend.Commit
+		)
+		gmtx, c, err = gm.attemptTransaction(f, opts)
+		if policy.OnAttempt != nil {
+			policy.OnAttempt(attempt, err)
+		}
+		if err == nil {
+			return gmtx, c, nil
+		}
+		if attempt >= policy.maxAttempts() || !policy.retryable(err) {
+			return gmtx, nil, err
+		}
+
+		wait := policy.backoff(attempt, rand.Float64)
+		if wait <= 0 {
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-gm.Context.Done():
+			t.Stop()
+			return gmtx, nil, gm.Context.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// attemptTransaction runs f in a new transaction and commits it.
+// The returned Gonm is the Gonm of the transaction, which is nil if the transaction did not start.
+func (gm *Gonm) attemptTransaction(f func(gm *Gonm) error, opts []datastore.TransactionOption) (*Gonm, backend.Commit, error) {
+	tx, err := gm.backend.NewTransaction(gm.Context, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	gmtx := gm.transactionGonm(tx, opts)
+	err = f(gmtx)
+	if err == nil {
+		err = gmtx.pending.joinedError()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return gmtx, nil, err
+	}
+	c, err := tx.Commit()
+	if err != nil {
+		return gmtx, nil, err
+	}
+	return gmtx, c, nil
+}
@@ -0,0 +1,102 @@
+package gonm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	noJitter := func() float64 { return 0.5 }
+	assert.Equal(10*time.Millisecond, policy.backoff(1, noJitter))
+	assert.Equal(20*time.Millisecond, policy.backoff(2, noJitter))
+	assert.Equal(40*time.Millisecond, policy.backoff(3, noJitter))
+	assert.Equal(50*time.Millisecond, policy.backoff(4, noJitter), "limited to MaxBackoff")
+	assert.Equal(50*time.Millisecond, policy.backoff(100, noJitter), "limited to MaxBackoff")
+
+	policy = &RetryPolicy{InitialBackoff: 10 * time.Millisecond, Multiplier: 3, Jitter: 0.5}
+	assert.Equal(30*time.Millisecond, policy.backoff(2, func() float64 { return 0 }))
+	assert.Equal(15*time.Millisecond, policy.backoff(2, func() float64 { return 1 }), "jitter")
+
+	assert.Equal(DefaultMaxAttempts, (&RetryPolicy{}).maxAttempts())
+	assert.True((&RetryPolicy{}).retryable(datastore.ErrConcurrentTransaction))
+	assert.False((&RetryPolicy{}).retryable(errors.New("error")))
+}
+
+func TestGonm_RunInTransactionRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	errRetry := errors.New("retry")
+	var attempts []error
+	gm := newTestGonm(ctx)
+	gm.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Jitter:         0.5,
+		Retryable:      func(err error) bool { return err == errRetry },
+		OnAttempt:      func(attempt int, err error) { attempts = append(attempts, err) },
+	}
+
+	putModel := &testModel{ID: 1, Name: "Michael"}
+	if _, err := gm.Put(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	key, err := getStructKey(putModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srcs []*testModel
+	_, err = gm.RunInTransaction(func(tx *Gonm) error {
+		src := &testModel{Name: "Tom"}
+		srcs = append(srcs, src)
+		if _, err := tx.PutMulti([]*testModel{src, {ID: 1, Name: "Jack"}}); err != nil {
+			return err
+		}
+		if len(srcs) < 3 {
+			return errRetry
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]error{errRetry, errRetry, nil}, attempts, "OnAttempt")
+	assert.Zero(srcs[0].ID, "discard pending of failed attempt")
+	assert.Zero(srcs[1].ID, "discard pending of failed attempt")
+	assert.NotZero(srcs[2].ID, "complement committed attempt")
+	_, ok := gm.cache.get(key)
+	assert.False(ok, "invalidate cache on commit")
+
+	if err := gm.Get(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	attempts = nil
+	_, err = gm.RunInTransaction(func(tx *Gonm) error {
+		if _, err := tx.Put(&testModel{ID: 1, Name: "Tom"}); err != nil {
+			return err
+		}
+		return errRetry
+	})
+	assert.Equal(errRetry, err)
+	assert.Len(attempts, 3, "MaxAttempts")
+	cached, ok := gm.cache.get(key)
+	assert.True(ok, "discard cache invalidation of failed attempts")
+	assert.Equal(putModel, cached)
+
+	attempts = nil
+	errOther := errors.New("other")
+	_, err = gm.RunInTransaction(func(tx *Gonm) error {
+		return errOther
+	})
+	assert.Equal(errOther, err)
+	assert.Len(attempts, 1, "not retryable")
+}
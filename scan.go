@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for parallel scan
+ */
+
+package gonm
+
+import (
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
+	"github.com/komem3/gonm/internal/keyorder"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultScanShards is the number of shards of Scan by default.
+const DefaultScanShards = 8
+
+// scanOversampling is the number of sampled keys per shard.
+const scanOversampling = 32
+
+// ScanOptions configures Scan.
+type ScanOptions struct {
+	// Shards is the number of key ranges. If Shards is zero, DefaultScanShards is used.
+	// Shards is ignored when SplitKeys or Resume is set.
+	Shards int
+	// SplitKeys are the keys that split the key range into len(SplitKeys)+1 shards.
+	// If SplitKeys is empty, the keys are sampled from the kind.
+	SplitKeys []*datastore.Key
+	// Concurrency is the maximum number of shards scanned at the same time.
+	// If Concurrency is zero, all shards are scanned at the same time.
+	Concurrency int
+	// Resume are the shards returned by Scan which failed. Scan scans the rest of them.
+	Resume []*ScanShard
+}
+
+// ScanShard is a key range scanned by Scan.
+type ScanShard struct {
+	// Start is the inclusive lower bound of the keys. Start is nil for the first shard.
+	Start *datastore.Key
+	// End is the exclusive upper bound of the keys. End is nil for the last shard.
+	End *datastore.Key
+	// Cursor is the position after the last entity passed to the callback.
+	Cursor datastore.Cursor
+	// Done reports whether the shard was scanned completely.
+	Done bool
+}
+
+// Scan runs q over shards of __key__ ranges concurrently and calls f with every entity.
+//
+// newDst returns a new destination of an entity, which is complemented with its key.
+// f is called concurrently from the shards, so f must be safe for concurrent use.
+// If f or a shard returns an error, Scan stops all shards and returns the error
+// with the shards, which are passed to ScanOptions.Resume to resume the scan.
+//
+// q must not have inequality filters or sort orders except on __key__, limit, offset, start or end,
+// which conflict with the key ranges of the shards, or *QueryError is returned.
+func (gm *Gonm) Scan(q *Query, opts *ScanOptions, newDst func() interface{}, f func(key *datastore.Key, dst interface{}) error) ([]*ScanShard, error) {
+	if gm.tx != nil {
+		return nil, gm.stackError("Scan", nil, ErrInTransaction)
+	}
+	if err := q.Err(); err != nil {
+		return nil, gm.stackError("Scan", nil, err)
+	}
+	if err := checkScanQuery(q.query.Description); err != nil {
+		return nil, gm.stackError("Scan", nil, err)
+	}
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+
+	shards := opts.Resume
+	if len(shards) == 0 {
+		splitKeys := opts.SplitKeys
+		if len(splitKeys) == 0 {
+			n := opts.Shards
+			if n <= 0 {
+				n = DefaultScanShards
+			}
+			var err error
+			if splitKeys, err = gm.sampleSplitKeys(q, n); err != nil {
+				return nil, err
+			}
+		}
+		shards = newScanShards(splitKeys)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = len(shards)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	eg, ctx := errgroup.WithContext(gm.Context)
+	sgm := gm.WithContext(ctx)
+	for _, shard := range shards {
+		if shard.Done {
+			continue
+		}
+		shard := shard
+		eg.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			return sgm.scanShard(q, shard, newDst, f)
+		})
+	}
+	return shards, eg.Wait()
+}
+
+func (gm *Gonm) scanShard(q *Query, shard *ScanShard, newDst func() interface{}, f func(key *datastore.Key, dst interface{}) error) error {
+	sq := q
+	if shard.Start != nil {
+		sq = sq.Filter("__key__ >=", shard.Start)
+	}
+	if shard.End != nil {
+		sq = sq.Filter("__key__ <", shard.End)
+	}
+	if shard.Cursor.String() != "" {
+		sq = sq.Start(shard.Cursor)
+	}
+
+	bq, err := sq.backendQuery()
+	if err != nil {
+		return gm.stackError("Scan", nil, err)
+	}
+	it, err := gm.run("Scan", bq, false)
+	if err != nil {
+		return err
+	}
+	for {
+		dst := newDst()
+		key, err := it.Next(dst)
+		if err == iterator.Done {
+			shard.Done = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(key, dst); err != nil {
+			return err
+		}
+		if shard.Cursor, err = it.Cursor(); err != nil {
+			return err
+		}
+	}
+}
+
+// checkScanQuery returns *QueryError if the query of info has inequality filters or orders except on __key__,
+// limit, offset, start or end, which Scan cannot split into key ranges.
+func checkScanQuery(info *backend.QueryDescription) error {
+	var parts []string
+	for _, f := range info.Filters {
+		if f.Op != "=" && f.Property != keyPropertyName {
+			parts = append(parts, "inequality filter on "+f.Property)
+		}
+	}
+	for _, o := range info.Orders {
+		if o.Property != keyPropertyName {
+			parts = append(parts, "order on "+o.Property)
+		}
+	}
+	if info.Limit >= 0 {
+		parts = append(parts, "limit")
+	}
+	if info.Offset != 0 {
+		parts = append(parts, "offset")
+	}
+	if info.Start.String() != "" {
+		parts = append(parts, "start")
+	}
+	if info.End.String() != "" {
+		parts = append(parts, "end")
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return &QueryError{Op: "Scan", Reason: "query must not have " + strings.Join(parts, ", ")}
+}
+
+// newScanShards returns the shards split by splitKeys.
+func newScanShards(splitKeys []*datastore.Key) []*ScanShard {
+	keys := append([]*datastore.Key(nil), splitKeys...)
+	sort.Slice(keys, func(i, j int) bool { return keyorder.Compare(keys[i], keys[j]) < 0 })
+
+	shards := []*ScanShard{{}}
+	for _, key := range keys {
+		last := shards[len(shards)-1]
+		if last.Start != nil && last.Start.Equal(key) {
+			continue
+		}
+		last.End = key
+		shards = append(shards, &ScanShard{Start: key})
+	}
+	return shards
+}
+
+// sampleSplitKeys returns the keys that split the kind of q into n shards.
+// On Google Cloud Datastore, the keys are sampled by __scatter__ property. On the other backends, all keys are read.
+func (gm *Gonm) sampleSplitKeys(q *Query, n int) ([]*datastore.Key, error) {
+	if n <= 1 {
+		return nil, nil
+	}
+	info := q.query.Description
+	desc := &backend.QueryDescription{Kind: info.Kind, Namespace: info.Namespace, Ancestor: info.Ancestor, Limit: -1}
+	dq := datastore.NewQuery(info.Kind).Namespace(info.Namespace)
+	if info.Ancestor != nil {
+		dq = dq.Ancestor(info.Ancestor)
+	}
+	if _, ok := gm.backend.(*datastoreBackend); ok {
+		// __scatter__ is not a property of the struct, so the query is built without Query.
+		dq = dq.Order("__scatter__").Limit(n * scanOversampling)
+	}
+	keys, _, err := gm.getKeysOnly("Scan", &backend.Query{Datastore: dq, Description: desc})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyorder.Compare(keys[i], keys[j]) < 0 })
+
+	var splitKeys []*datastore.Key
+	for i := 1; i < n; i++ {
+		if idx := i * len(keys) / n; idx < len(keys) {
+			splitKeys = append(splitKeys, keys[idx])
+		}
+	}
+	return splitKeys, nil
+}
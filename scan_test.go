@@ -0,0 +1,107 @@
+package gonm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGonm_Scan(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := make([]*testModel, 20)
+	for i := range putModel {
+		putModel[i] = &testModel{ID: int64(i + 1), Name: "Michael"}
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	q := gm.Query(&testModel{})
+	splitKeys := []*datastore.Key{datastore.IDKey(Kind(testModel{}), 10, nil), datastore.IDKey(Kind(testModel{}), 5, nil)}
+	newDst := func() interface{} { return &testModel{} }
+
+	var m sync.Mutex
+	seen := make(map[int64]bool)
+	errStop := errors.New("stop")
+	shards, err := gm.Scan(q, &ScanOptions{SplitKeys: splitKeys, Concurrency: 2}, newDst, func(key *datastore.Key, dst interface{}) error {
+		m.Lock()
+		defer m.Unlock()
+		if key.ID == 7 {
+			return errStop
+		}
+		assert.Equal(key.ID, dst.(*testModel).ID, "set struct key")
+		seen[key.ID] = true
+		return nil
+	})
+	assert.True(errors.Is(err, errStop))
+	assert.Len(shards, 3)
+
+	_, err = gm.Scan(q, &ScanOptions{Resume: shards}, newDst, func(key *datastore.Key, dst interface{}) error {
+		m.Lock()
+		defer m.Unlock()
+		seen[key.ID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	for _, model := range putModel {
+		assert.True(seen[model.ID], "scan all entities")
+	}
+}
+
+func TestGonm_ScanInvalidQuery(t *testing.T) {
+	gm := newTestGonm(context.Background())
+	newDst := func() interface{} { return &testModel{} }
+	f := func(key *datastore.Key, dst interface{}) error {
+		t.Error("f is called")
+		return nil
+	}
+
+	tests := []struct {
+		name  string
+		query *Query
+	}{
+		{"order", gm.Query(&testModel{}).Order("Name")},
+		{"inequality filter", gm.Query(&testModel{}).Filter("Name >", "M")},
+		{"limit", gm.Query(&testModel{}).Limit(10)},
+		{"offset", gm.Query(&testModel{}).Offset(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := gm.Scan(tt.query, nil, newDst, f)
+			var qerr *QueryError
+			if assert.True(t, errors.As(err, &qerr), "returns *QueryError") {
+				assert.Equal(t, "Scan", qerr.Op)
+			}
+		})
+	}
+
+	t.Run("key", func(t *testing.T) {
+		q := gm.Query(&testModel{}).Filter("__key__ >", datastore.IDKey(Kind(testModel{}), 1, nil)).Order("__key__")
+		if _, err := gm.Scan(q, nil, newDst, func(*datastore.Key, interface{}) error { return nil }); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+	})
+}
+
+func TestNewScanShards(t *testing.T) {
+	assert := assert.New(t)
+
+	k1 := datastore.IDKey("testModel", 1, nil)
+	k2 := datastore.NameKey("testModel", "a", nil)
+	shards := newScanShards([]*datastore.Key{k2, k1, k2})
+	assert.Equal([]*ScanShard{
+		{End: k1},
+		{Start: k1, End: k2},
+		{Start: k2},
+	}, shards)
+}
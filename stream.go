@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for streaming query results
+ */
+
+package gonm
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// StreamItem is a result of Stream.
+type StreamItem struct {
+	Key *datastore.Key
+	// Entity is the destination returned by newDst of Stream, which is complemented with Key.
+	Entity interface{}
+	// Err is the error occurred while running the query. Err is the last item of the channel.
+	Err error
+}
+
+// Stream runs q and sends the results to the returned channel.
+//
+// newDst returns a new destination of an entity. The next result is read only after the previous one is received,
+// so a slow receiver does not make results pile up in memory.
+// The channel is closed when all results are sent, after an item with Err, or when ctx is done.
+// Closing by ctx does not send an item, so the receiver checks ctx.Err() to know whether all results were received.
+// stop stops the query and waits for the channel to be closed. stop may be called more than once.
+func (gm *Gonm) Stream(ctx context.Context, q *Query, newDst func() interface{}) (items <-chan StreamItem, stop func()) {
+	ch := make(chan StreamItem)
+	ctx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+
+	stop = func() {
+		cancel()
+		<-finished
+	}
+
+	go func() {
+		defer close(finished)
+		defer close(ch)
+		defer cancel()
+
+		send := func(item StreamItem) bool {
+			select {
+			case ch <- item:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		bq, err := q.backendQuery()
+		if err != nil {
+			send(StreamItem{Err: gm.stackError("Stream", nil, err)})
+			return
+		}
+		it, err := gm.WithContext(ctx).run("Stream", bq, false)
+		if err != nil {
+			send(StreamItem{Err: err})
+			return
+		}
+		for {
+			dst := newDst()
+			key, err := it.Next(dst)
+			if err == iterator.Done || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				send(StreamItem{Err: err})
+				return
+			}
+			if !send(StreamItem{Key: key, Entity: dst}) {
+				return
+			}
+		}
+	}()
+	return ch, stop
+}
@@ -0,0 +1,61 @@
+package gonm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGonm_Stream(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := []*testModel{
+		{ID: 1, Name: "Michael"},
+		{ID: 2, Name: "Tom"},
+		{ID: 3, Name: "Jack"},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	q := gm.Query(&testModel{}).Order("__key__").Limit(3)
+	newDst := func() interface{} { return &testModel{} }
+
+	t.Run("all", func(t *testing.T) {
+		items, stop := gm.Stream(ctx, q, newDst)
+		defer stop()
+
+		var got []*testModel
+		for item := range items {
+			if item.Err != nil {
+				t.Fatal(gm.printStackErrs(item.Err))
+			}
+			got = append(got, item.Entity.(*testModel))
+		}
+		assert.Equal(putModel, got, "Stream and complete ID")
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		items, stop := gm.Stream(ctx, q, newDst)
+		item := <-items
+		assert.Equal(putModel[0], item.Entity)
+		stop()
+		_, ok := <-items
+		assert.False(ok, "closed by stop")
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		items, stop := gm.Stream(ctx, q, newDst)
+		defer stop()
+		<-items
+		cancel()
+		for range items {
+		}
+		assert.Equal(context.Canceled, ctx.Err())
+	})
+}
@@ -8,10 +8,10 @@ package gonm
 
 import (
 	"context"
-	"fmt"
 	"reflect"
 
 	"cloud.google.com/go/datastore"
+	"github.com/komem3/gonm/internal/backend"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -19,7 +19,12 @@ import (
 type Transaction struct {
 	Transaction *datastore.Transaction
 	Context     context.Context
-	gonm        *Gonm
+
+	// Errors keeps the latest errors occurred in methods of Transaction.
+	// Errors is shared with the Gonm that started the transaction.
+	Errors *ErrorJournal
+
+	gonm *Gonm
 }
 
 // RunInTransaction runs f in Transaction.
@@ -27,55 +32,230 @@ type Transaction struct {
 // Get, GetMulti, GetByKey, GetConsistency, GetMultiByKeys, GetMultiConsistency, GetPut, PutMulti, Delete, DeleteMulti, are only method that can be used.
 // Also, Put and PutMulti in Gonm of Transaction do not return datastore.Key (return nil), but, all structures are complemented with IDs after transaction.
 // If you want to get pending key, you should use NewTransaction or *Gonm.Transaction.Put(key, src).
+//
+// If gm.RetryPolicy is set, the transaction is retried according to it, and MaxAttempts is ignored.
+// The structures put and the cache invalidations of failed attempts are discarded.
+//
+// If gm does not run on Google Cloud Datastore, the returned Commit is nil, and the structures are still complemented with keys.
+//
+// If gm is in transaction and gm.JoinTransaction is true, f runs in the outer transaction.
+// Then the returned Commit is nil, and the outer transaction is rolled back if f returns an error,
+// even if the outer function does not return the error. If gm.JoinTransaction is false, ErrNestedTransaction is returned.
+// The options of the outer transaction cannot be changed, so joining with otps returns ErrJoinTransactionOptions without running f.
 func (gm *Gonm) RunInTransaction(f func(gm *Gonm) error, otps ...datastore.TransactionOption) (cmt *datastore.Commit, err error) {
+	if gm.tx != nil {
+		if gm.JoinTransaction && len(otps) > 0 {
+			return nil, gm.stackError("RunInTransaction", nil, ErrJoinTransactionOptions)
+		}
+		return nil, gm.joinTransaction(f)
+	}
+	if !gm.readTime.IsZero() {
+		return nil, gm.stackError("RunInTransaction", nil, ErrUnsupported)
+	}
 
-	gmtx := &Gonm{Context: gm.Context, cache: gm.cache}
-	cmt, err = gm.Client.RunInTransaction(gm.Context, func(tx *datastore.Transaction) error {
-		gmtx.Transaction = tx
-		return f(gmtx)
-	}, otps...)
+	var (
+		gmtx *Gonm
+		c    backend.Commit
+	)
+	if gm.RetryPolicy != nil {
+		gmtx, c, err = gm.runWithRetryPolicy(f, otps)
+	} else {
+		c, err = gm.backend.RunInTransaction(gm.Context, func(tx backend.Transaction) error {
+			gmtx = gm.transactionGonm(tx, otps)
+			if err := f(gmtx); err != nil {
+				return err
+			}
+			return gmtx.pending.joinedError()
+		}, otps...)
+	}
 
 	if err != nil {
-		gm.Errors = append(gm.Errors, gmtx.Errors...)
+		if gmtx != nil {
+			gmtx.runOnRollback(err)
+		}
 		return nil, err
 	}
 
-	for _, pending := range gmtx.pending {
-		key := cmt.Key(pending.pkey)
-		if err := setStructKey(pending.dst, key); err != nil {
-			return cmt, gm.stackError(err)
+	cmt = datastoreCommitOf(c)
+	err = gmtx.resolvePending("RunInTransaction", c)
+	gmtx.runOnCommit(cmt)
+	return cmt, err
+}
+
+// joinTransaction runs f in the transaction of gm.
+func (gm *Gonm) joinTransaction(f func(gm *Gonm) error) error {
+	if !gm.JoinTransaction {
+		return gm.stackError("RunInTransaction", nil, ErrNestedTransaction)
+	}
+	if err := f(gm); err != nil {
+		gm.pending.m.Lock()
+		if gm.pending.failed == nil {
+			gm.pending.failed = err
+		}
+		gm.pending.m.Unlock()
+		return err
+	}
+	return nil
+}
+
+// OnCommit registers f which is called after the transaction of gm is committed
+// and the structures put in it are complemented with keys.
+// f receives the Commit returned by RunInTransaction or Transaction.Commit.
+//
+// In RunInTransaction, only f registered in the committed attempt is called.
+// OnCommit panics if gm is not in transaction.
+func (gm *Gonm) OnCommit(f func(*datastore.Commit)) {
+	if gm.tx == nil {
+		panic("gonm: OnCommit is called out of transaction")
+	}
+	gm.pending.m.Lock()
+	defer gm.pending.m.Unlock()
+
+	gm.pending.onCommit = append(gm.pending.onCommit, f)
+}
+
+// OnRollback registers f which is called with the cause after the transaction of gm is rolled back
+// or fails to commit. The cause is nil when Transaction.Rollback is called.
+//
+// In RunInTransaction, f registered in retried attempts is not called.
+// OnRollback panics if gm is not in transaction.
+func (gm *Gonm) OnRollback(f func(error)) {
+	if gm.tx == nil {
+		panic("gonm: OnRollback is called out of transaction")
+	}
+	gm.pending.m.Lock()
+	defer gm.pending.m.Unlock()
+
+	gm.pending.onRollback = append(gm.pending.onRollback, f)
+}
+
+func (gm *Gonm) runOnCommit(cmt *datastore.Commit) {
+	gm.pending.m.Lock()
+	hooks := gm.pending.onCommit
+	gm.pending.m.Unlock()
+
+	for _, f := range hooks {
+		f(cmt)
+	}
+}
+
+func (gm *Gonm) runOnRollback(err error) {
+	gm.pending.m.Lock()
+	hooks := gm.pending.onRollback
+	gm.pending.m.Unlock()
+
+	for _, f := range hooks {
+		f(err)
+	}
+}
+
+// transactionGonm generate Gonm of tx which shares cache and Errors with gm.
+// The Gonm is read-only if opts has datastore.ReadOnly.
+func (gm *Gonm) transactionGonm(tx backend.Transaction, opts []datastore.TransactionOption) *Gonm {
+	gmtx := &Gonm{
+		Context:         gm.Context,
+		Errors:          gm.Errors,
+		PageTokenKey:    gm.PageTokenKey,
+		RetryPolicy:     gm.RetryPolicy,
+		JoinTransaction: gm.JoinTransaction,
+		backend:         gm.backend,
+		tx:              tx,
+		cache:           gm.cache,
+		pending:         &pendingList{},
+		readOnly:        hasReadOnly(opts),
+	}
+	if dtx, ok := tx.(*datastoreTransaction); ok {
+		gmtx.Transaction = dtx.tx
+	}
+	return gmtx
+}
+
+// MaxAttempts returns the transaction option of the number of attempts of RunInTransaction.
+//
+// Unlike datastore.MaxAttempts, which only Google Cloud Datastore reads, MaxAttempts is honored by every Backend.
+func MaxAttempts(attempts int) datastore.TransactionOption {
+	return backend.MaxAttempts{TransactionOption: datastore.MaxAttempts(attempts), Attempts: attempts}
+}
+
+func hasReadOnly(opts []datastore.TransactionOption) bool {
+	for _, opt := range opts {
+		if opt == datastore.ReadOnly {
+			return true
 		}
 	}
+	return false
+}
 
-	return cmt, nil
+// resolvePending complements the structures put in the transaction with the committed keys,
+// and removes the keys written in the transaction from the cache.
+func (gm *Gonm) resolvePending(op string, c backend.Commit) error {
+	for _, key := range gm.pending.invalidated {
+		gm.cache.delete(key)
+	}
+	for _, v := range gm.pending.versions {
+		v.field.SetInt(v.version)
+	}
+	for _, pending := range gm.pending.list {
+		key := c.Key(pending.pkey)
+		if err := setStructKey(pending.dst, key); err != nil {
+			return gm.stackError(op, []*datastore.Key{key}, err)
+		}
+	}
+	return nil
 }
 
 // NewTransaction starts a new Transaction.
-// Get, GetMulti, GetByKey, GetMultiByKeys, GetPut, PutMulti, Delete, and DeleteMulti are only method that can be used.
+// Transaction has the read and write methods of Gonm, and queries of Transaction must be ancestor queries.
 func (gm *Gonm) NewTransaction(otps ...datastore.TransactionOption) (gmtx *Transaction, err error) {
-	if gm.Transaction != nil {
-		return nil, gm.stackError(ErrInTransaction)
+	if gm.tx != nil {
+		return nil, gm.stackError("NewTransaction", nil, ErrInTransaction)
 	}
-	t, err := gm.Client.NewTransaction(gm.Context, otps...)
+	if !gm.readTime.IsZero() {
+		return nil, gm.stackError("NewTransaction", nil, ErrUnsupported)
+	}
+	t, err := gm.backend.NewTransaction(gm.Context, otps...)
 	if err != nil {
 		return nil, err
 	}
-	return &Transaction{Transaction: t, Context: gm.Context, gonm: &Gonm{Transaction: t, cache: gm.cache}}, nil
+	gmtxGonm := gm.transactionGonm(t, otps)
+	return &Transaction{Transaction: gmtxGonm.Transaction, Context: gm.Context, Errors: gm.Errors, gonm: gmtxGonm}, nil
 }
 
 // Commit applies the enqueued operations atomically.
+// If gmtx does not run on Google Cloud Datastore, the returned Commit is nil.
+// If f of Transaction.RunInTransaction returned an error, Commit rolls back the transaction and returns the error.
 func (gmtx *Transaction) Commit() (cm *datastore.Commit, err error) {
-	cm, err = gmtx.Transaction.Commit()
-	if err != nil {
+	if err := gmtx.gonm.pending.joinedError(); err != nil {
+		_ = gmtx.gonm.tx.Rollback()
+		gmtx.gonm.runOnRollback(err)
 		return nil, err
 	}
-	for _, pending := range gmtx.gonm.pending {
-		key := cm.Key(pending.pkey)
-		if err := setStructKey(pending.dst, key); err != nil {
-			return cm, gmtx.gonm.stackError(err)
-		}
+	c, err := gmtx.gonm.tx.Commit()
+	if err != nil {
+		gmtx.gonm.runOnRollback(err)
+		return nil, err
 	}
-	return cm, nil
+	cm = datastoreCommitOf(c)
+	err = gmtx.gonm.resolvePending("Transaction.Commit", c)
+	gmtx.gonm.runOnCommit(cm)
+	return cm, err
+}
+
+// RunInTransaction is similar as Gonm.RunInTransaction in transaction.
+// If JoinTransaction of the Gonm that started the transaction is true, f runs in the transaction,
+// and Commit rolls back the transaction if f returns an error. Otherwise, ErrNestedTransaction is returned.
+func (gmtx *Transaction) RunInTransaction(f func(gm *Gonm) error) error {
+	return gmtx.gonm.joinTransaction(f)
+}
+
+// OnCommit is similar as Gonm.OnCommit
+func (gmtx *Transaction) OnCommit(f func(*datastore.Commit)) {
+	gmtx.gonm.OnCommit(f)
+}
+
+// OnRollback is similar as Gonm.OnRollback
+func (gmtx *Transaction) OnRollback(f func(error)) {
+	gmtx.gonm.OnRollback(f)
 }
 
 // Delete is similar as Gonm.Delete
@@ -98,19 +278,95 @@ func (gmtx *Transaction) GetMulti(dst interface{}) error {
 	return gmtx.gonm.GetMulti(dst)
 }
 
+// GetConsistency is similar as Gonm.GetConsistency
+func (gmtx *Transaction) GetConsistency(dst interface{}) error {
+	return gmtx.gonm.GetConsistency(dst)
+}
+
+// GetMultiConsistency is similar as Gonm.GetMultiConsistency
+func (gmtx *Transaction) GetMultiConsistency(dst interface{}) error {
+	return gmtx.gonm.GetMultiConsistency(dst)
+}
+
+// GetByKey is similar as Gonm.GetByKey
+func (gmtx *Transaction) GetByKey(key *datastore.Key, dst interface{}) error {
+	return gmtx.gonm.GetByKey(key, dst)
+}
+
+// GetMultiByKeys is similar as Gonm.GetMultiByKeys
+func (gmtx *Transaction) GetMultiByKeys(keys []*datastore.Key, dst interface{}) error {
+	return gmtx.gonm.GetMultiByKeys(keys, dst)
+}
+
+// GetMultiPartial is similar as Gonm.GetMultiPartial
+func (gmtx *Transaction) GetMultiPartial(dst interface{}) ([]bool, error) {
+	return gmtx.gonm.GetMultiPartial(dst)
+}
+
+// GetMultiByKeysPartial is similar as Gonm.GetMultiByKeysPartial
+func (gmtx *Transaction) GetMultiByKeysPartial(keys []*datastore.Key, dst interface{}) ([]bool, error) {
+	return gmtx.gonm.GetMultiByKeysPartial(keys, dst)
+}
+
+// Run is similar as Gonm.Run. q must be an ancestor query.
+func (gmtx *Transaction) Run(q *datastore.Query) (*Iterator, error) {
+	return gmtx.gonm.Run(q)
+}
+
+// GetAll is similar as Gonm.GetAll. q must be an ancestor query.
+func (gmtx *Transaction) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return gmtx.gonm.GetAll(q, dst)
+}
+
+// GetKeysOnly is similar as Gonm.GetKeysOnly. q must be an ancestor query.
+func (gmtx *Transaction) GetKeysOnly(q *datastore.Query) ([]*datastore.Key, datastore.Cursor, error) {
+	return gmtx.gonm.GetKeysOnly(q)
+}
+
+// GetProjection is similar as Gonm.GetProjection. q must be an ancestor query.
+func (gmtx *Transaction) GetProjection(q *Query, dst interface{}) ([]*datastore.Key, error) {
+	return gmtx.gonm.GetProjection(q, dst)
+}
+
+// Paginate is similar as Gonm.Paginate. q must be an ancestor query.
+func (gmtx *Transaction) Paginate(q *Query, pageSize int, token string, dst interface{}) (*Page, error) {
+	return gmtx.gonm.Paginate(q, pageSize, token, dst)
+}
+
+// Count is similar as Gonm.Count. q must be an ancestor query.
+func (gmtx *Transaction) Count(q *Query) (int, error) {
+	return gmtx.gonm.Count(q)
+}
+
+// Sum is similar as Gonm.Sum. q must be an ancestor query.
+func (gmtx *Transaction) Sum(q *Query, property string) (float64, error) {
+	return gmtx.gonm.Sum(q, property)
+}
+
+// Avg is similar as Gonm.Avg. q must be an ancestor query.
+func (gmtx *Transaction) Avg(q *Query, property string) (float64, error) {
+	return gmtx.gonm.Avg(q, property)
+}
+
+// Query is similar as Gonm.Query. The query must have an ancestor to run.
+func (gmtx *Transaction) Query(src interface{}) *Query {
+	return gmtx.gonm.Query(src)
+}
+
 // Mutate is similar as Gonm.Mutation
 func (gmtx *Transaction) Mutate(gmuts ...*Mutation) (ret []*datastore.Key, err error) {
 	return gmtx.gonm.Mutate(gmuts...)
 }
 
-// Put is similar as Gonm.Put, but this method return datastore.PendingKey.
+// Put is similar as Gonm.Put, but this method return PendingKey.
 //
 // This method do not change incomple key to complete key.
-// If you want to use datastore.Key, you may use Commit.commit(pendingKey)
+// If you want to use datastore.Key, you may use Commit.Key(pendingKey)
+// If gmtx does not run on Google Cloud Datastore, PendingKey is nil.
 func (gmtx *Transaction) Put(src interface{}) (*datastore.PendingKey, error) {
 	v := reflect.ValueOf(src)
 	if v.Kind() != reflect.Ptr {
-		return nil, gmtx.gonm.stackError(fmt.Errorf("gonm: expected pointer to a struct, got %#v", src))
+		return nil, gmtx.gonm.stackError("Transaction.Put", nil, invalidType(src, "pointer to a struct"))
 	}
 	ks, err := gmtx.PutMulti([]interface{}{src})
 	if err != nil {
@@ -123,16 +379,28 @@ func (gmtx *Transaction) Put(src interface{}) (*datastore.PendingKey, error) {
 }
 
 // PutMulti is a bach version of Put.
+// The returned PendingKeys correspond to src.
 func (gmtx *Transaction) PutMulti(src interface{}) ([]*datastore.PendingKey, error) {
+	if gmtx.gonm.readOnly {
+		return nil, gmtx.gonm.stackError("Transaction.PutMulti", nil, ErrReadOnly)
+	}
 	keys, err := extractKeys(src, true) // allow incomplete keys on a Put request
 	if err != nil {
-		return nil, gmtx.gonm.stackError(err)
+		return nil, gmtx.gonm.stackError("Transaction.PutMulti", nil, err)
 	}
 
 	v := reflect.Indirect(reflect.ValueOf(src))
+	var versions []versionedStruct
+	if hasVersionField(v) {
+		versions, err = gmtx.gonm.checkVersions(keys, structValues(v))
+		if err != nil {
+			return nil, gmtx.gonm.stackError("Transaction.PutMulti", keys, err)
+		}
+		defer setVersions(versions)()
+	}
 	goroutines := (len(keys)-1)/datastorePutMultiMaxItems + 1
-	var pendingKeys []*datastore.PendingKey
-	var multiError datastore.MultiError
+	pendingKeys := make([]*datastore.PendingKey, len(keys))
+	multiError := newBatchError(len(keys))
 
 	var eg errgroup.Group
 	for i := 0; i < goroutines; i++ {
@@ -144,32 +412,24 @@ func (gmtx *Transaction) PutMulti(src interface{}) ([]*datastore.PendingKey, err
 				hi = len(keys)
 			}
 
-			pkeys, err := gmtx.Transaction.PutMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
+			pkeys, err := gmtx.gonm.tx.PutMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
 
 			if err != nil {
-				if merr, ok := err.(datastore.MultiError); ok {
-					multiError = append(multiError, merr...)
-				}
+				multiError.set(lo, hi, err)
 				for _, key := range keys[lo:hi] {
 					if !key.Incomplete() {
-						gmtx.gonm.cache.delete(key)
+						gmtx.gonm.invalidate(key)
 					}
 				}
-				return gmtx.gonm.stackError(err)
+				return gmtx.gonm.stackError("Transaction.PutMulti", keys[lo:hi], err)
 			}
 
 			for i, key := range keys[lo:hi] {
+				pendingKeys[lo+i], _ = pkeys[i].(*datastore.PendingKey)
 				if key.Incomplete() {
-					gmtx.gonm.m.Lock()
-					gmtx.gonm.pending = append(gmtx.gonm.pending,
-						&pendingStruct{
-							pkey: pkeys[i],
-							dst:  v.Slice(lo, hi).Index(i).Interface(),
-						})
-					pendingKeys = append(pendingKeys, pkeys[i])
-					gmtx.gonm.m.Unlock()
+					gmtx.gonm.pending.add(pkeys[i], v.Slice(lo, hi).Index(i).Interface())
 				} else {
-					gmtx.gonm.cache.delete(key)
+					gmtx.gonm.invalidate(key)
 				}
 			}
 			return nil
@@ -177,10 +437,10 @@ func (gmtx *Transaction) PutMulti(src interface{}) ([]*datastore.PendingKey, err
 	}
 
 	if err := eg.Wait(); err != nil {
-		if len(multiError) > 0 {
-			return pendingKeys, multiError
-		}
-		return pendingKeys, err
+		return pendingKeys, multiError.result(err)
+	}
+	if versions != nil {
+		gmtx.gonm.pending.addVersions(versions)
 	}
 
 	return pendingKeys, nil
@@ -188,5 +448,9 @@ func (gmtx *Transaction) PutMulti(src interface{}) ([]*datastore.PendingKey, err
 
 // Rollback abandons a pending Transaction.
 func (gmtx *Transaction) Rollback() (err error) {
-	return gmtx.Transaction.Rollback()
+	if err := gmtx.gonm.tx.Rollback(); err != nil {
+		return err
+	}
+	gmtx.gonm.runOnRollback(nil)
+	return nil
 }
@@ -2,6 +2,7 @@ package gonm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -14,7 +15,7 @@ func TestGonm_RunInTransaction(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	t.Run("simple Transaction", func(t *testing.T) {
 		putModel := []testModel{
@@ -124,7 +125,7 @@ func TestGonm_NewTransaction(t *testing.T) {
 	ctx := context.Background()
 
 	var err error
-	gm := FromContext(ctx, testDsClient)
+	gm := newTestGonm(ctx)
 
 	t.Run("simple Transaction", func(t *testing.T) {
 		putModel := []testModel{
@@ -232,3 +233,305 @@ func TestGonm_NewTransaction(t *testing.T) {
 		assert.Equal(deleteModel, getModel, "gostore GetDelete when callback")
 	})
 }
+
+func TestGonm_RunInTransactionQuery(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	parent := datastore.NameKey("testGroup", "query", nil)
+	putModel := []*testModel2{
+		{IDOther: 1, Name: "Michael", Parent: parent},
+		{IDOther: 2, Name: "Tom", Parent: parent},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	t.Run("ancestor query", func(t *testing.T) {
+		_, err := gm.RunInTransaction(func(gm *Gonm) error {
+			var getModel []*testModel2
+			if _, err := gm.GetAll(datastore.NewQuery("test").Ancestor(parent), &getModel); err != nil {
+				return err
+			}
+			assert.Len(getModel, 2)
+			for _, model := range getModel {
+				model.Name += "!"
+			}
+			_, err := gm.PutMulti(getModel)
+			return err
+		})
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+
+		getModel := &testModel2{IDOther: 1, Parent: parent}
+		if err := gm.GetConsistency(getModel); err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal("Michael!", getModel.Name)
+	})
+
+	t.Run("transaction ancestor query", func(t *testing.T) {
+		tx, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		defer tx.Rollback()
+
+		keys, _, err := tx.GetKeysOnly(datastore.NewQuery("test").Ancestor(parent))
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Len(keys, 2)
+	})
+
+	t.Run("no ancestor", func(t *testing.T) {
+		_, err := gm.RunInTransaction(func(gm *Gonm) error {
+			_, err := gm.Query(&testModel2{}).Run()
+			return err
+		})
+		assert.Equal(ErrNoAncestor, err)
+	})
+}
+
+func TestGonm_TransactionHooks(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	t.Run("RunInTransaction", func(t *testing.T) {
+		errRetry := errors.New("retry")
+		gm := gm.WithContext(ctx)
+		gm.RetryPolicy = &RetryPolicy{Retryable: func(err error) bool { return err == errRetry }}
+
+		var (
+			attempts  int
+			committed []int
+			cmt       *datastore.Commit
+		)
+		src := &testModel{Name: "Michael"}
+		c, err := gm.RunInTransaction(func(tx *Gonm) error {
+			attempts++
+			attempt := attempts
+			tx.OnCommit(func(c *datastore.Commit) {
+				assert.NotZero(src.ID, "run after resolving pending keys")
+				committed = append(committed, attempt)
+				cmt = c
+			})
+			tx.OnRollback(func(err error) {
+				t.Errorf("rollback hook of attempt %d is called", attempt)
+			})
+			if _, err := tx.Put(src); err != nil {
+				return err
+			}
+			if attempts < 2 {
+				return errRetry
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		assert.Equal([]int{2}, committed, "only committed attempt")
+		assert.Equal(c, cmt)
+
+		var rollbacks []error
+		errFailed := errors.New("failed")
+		_, err = gm.RunInTransaction(func(tx *Gonm) error {
+			tx.OnCommit(func(*datastore.Commit) {
+				t.Error("commit hook is called")
+			})
+			tx.OnRollback(func(err error) {
+				rollbacks = append(rollbacks, err)
+			})
+			return errFailed
+		})
+		assert.Equal(errFailed, err)
+		assert.Equal([]error{errFailed}, rollbacks)
+	})
+
+	t.Run("Transaction", func(t *testing.T) {
+		gmtx, err := gm.NewTransaction()
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		src := &testModel{Name: "Tom"}
+		var (
+			pkey     *datastore.PendingKey
+			resolved *datastore.Key
+		)
+		gmtx.OnCommit(func(c *datastore.Commit) {
+			assert.NotZero(src.ID, "run after resolving pending keys")
+			resolved = c.Key(pkey)
+		})
+		if pkey, err = gmtx.Put(src); err != nil {
+			t.Fatal(gmtx.printStackErrs(err))
+		}
+		if _, err := gmtx.Commit(); err != nil {
+			t.Fatal(gmtx.printStackErrs(err))
+		}
+		if testDsClient != nil {
+			assert.Equal(datastore.IDKey("testModel", src.ID, nil), resolved, "resolve pending key by the commit of the hook")
+		} else {
+			assert.Nil(resolved, "the memory backend has no datastore.Commit")
+		}
+
+		gmtx, err = gm.NewTransaction()
+		if err != nil {
+			t.Fatal(gm.printStackErrs(err))
+		}
+		var rollbacks []error
+		gmtx.OnRollback(func(err error) {
+			rollbacks = append(rollbacks, err)
+		})
+		if err := gmtx.Rollback(); err != nil {
+			t.Fatal(gmtx.printStackErrs(err))
+		}
+		assert.Equal([]error{nil}, rollbacks)
+	})
+
+	assert.Panics(func() { gm.OnCommit(func(*datastore.Commit) {}) }, "out of transaction")
+}
+
+func TestTransaction_Methods(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+	parent := datastore.NameKey("Group", "transaction", nil)
+	putModel := []*testScoreModel{
+		{ID: 1, Group: "a", Score: 10},
+		{ID: 2, Group: "b", Score: 20},
+	}
+	keys := make([]*datastore.Key, len(putModel))
+	for i, m := range putModel {
+		keys[i] = datastore.IDKey(Kind(testScoreModel{}), m.ID, parent)
+	}
+	if _, err := gm.backend.PutMulti(ctx, keys, putModel); err != nil {
+		t.Fatal(err)
+	}
+
+	gmtx, err := gm.NewTransaction()
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	defer gmtx.Rollback()
+
+	getModel := &testScoreModel{}
+	if err := gmtx.GetByKey(keys[0], getModel); err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal(putModel[0].Score, getModel.Score, "GetByKey")
+
+	getModels := make([]testScoreModel, 2)
+	if err := gmtx.GetMultiByKeys(keys, getModels); err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal(putModel[1].Score, getModels[1].Score, "GetMultiByKeys")
+
+	found, err := gmtx.GetMultiByKeysPartial(append(keys, datastore.IDKey(Kind(testScoreModel{}), 3, parent)), make([]testScoreModel, 3))
+	if err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal([]bool{true, true, false}, found, "GetMultiByKeysPartial")
+
+	q := gm.Query(&testScoreModel{}).AncestorKey(parent)
+	n, err := gmtx.Count(q)
+	if err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal(2, n, "Count")
+
+	var groups []testScoreModel
+	if _, err := gmtx.GetProjection(q.Project("Group").Order("Group"), &groups); err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal([]testScoreModel{{ID: 1, Group: "a"}, {ID: 2, Group: "b"}}, groups, "GetProjection")
+
+	_, err = gmtx.Count(gm.Query(&testScoreModel{}))
+	assert.Equal(ErrNoAncestor, err)
+	assert.Equal(gm.Errors, gmtx.Errors, "share Errors")
+	entries := gmtx.Errors.Entries()
+	assert.Equal("Count", entries[len(entries)-1].Op, "report errors")
+
+	pkey, err := gmtx.Put(&testModel{ID: 10, Name: "Michael"})
+	if err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Nil(pkey, "complete key")
+}
+
+func TestGonm_NestedTransaction(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+	putName := func(gm *Gonm, id int64, name string) error {
+		_, err := gm.RunInTransaction(func(tx *Gonm) error {
+			_, err := tx.Put(&testModel{ID: id, Name: name})
+			return err
+		})
+		return err
+	}
+
+	_, err := gm.RunInTransaction(func(tx *Gonm) error {
+		return putName(tx, 1, "Michael")
+	})
+	assert.Equal(ErrNestedTransaction, err)
+
+	gm.JoinTransaction = true
+	if err := putName(gm, 1, "Michael"); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	_, err = gm.RunInTransaction(func(tx *Gonm) error {
+		if err := putName(tx, 1, "Tom"); err != nil {
+			return err
+		}
+		return putName(tx, 2, "Jack")
+	})
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	getModel := []*testModel{{ID: 1}, {ID: 2}}
+	if err := gm.GetMultiConsistency(getModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal([]*testModel{{ID: 1, Name: "Tom"}, {ID: 2, Name: "Jack"}}, getModel, "join outer transaction")
+
+	errJoined := errors.New("joined")
+	_, err = gm.RunInTransaction(func(tx *Gonm) error {
+		if _, err := tx.Put(&testModel{ID: 1, Name: "Hanako"}); err != nil {
+			return err
+		}
+		_, _ = tx.RunInTransaction(func(*Gonm) error {
+			return errJoined
+		})
+		return nil
+	})
+	assert.Equal(errJoined, err, "roll back on error of joined function")
+	getModel[0] = &testModel{ID: 1}
+	if err := gm.GetConsistency(getModel[0]); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal("Tom", getModel[0].Name)
+
+	_, err = gm.RunInTransaction(func(tx *Gonm) error {
+		_, err := tx.RunInTransaction(func(*Gonm) error {
+			t.Error("f is called with options")
+			return nil
+		}, datastore.ReadOnly)
+		return err
+	})
+	assert.Equal(ErrJoinTransactionOptions, err, "options of joined transaction")
+
+	gmtx, err := gm.NewTransaction()
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(errJoined, gmtx.RunInTransaction(func(*Gonm) error { return errJoined }))
+	_, err = gmtx.Commit()
+	assert.Equal(errJoined, err, "Commit rolls back")
+}
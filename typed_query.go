@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for generic query builder
+ */
+
+package gonm
+
+import (
+	"cloud.google.com/go/datastore"
+)
+
+// TypedQuery is a type-safe Query of T.
+//
+//	q := gonm.NewQuery[User]().Filter("Name =", "Tom").Order("-Age")
+//	users, keys, err := q.GetAll(gm)
+type TypedQuery[T any] struct {
+	q *Query
+}
+
+// NewQuery creates a new TypedQuery for the kind of T.
+func NewQuery[T any]() *TypedQuery[T] {
+	return &TypedQuery[T]{q: newQuery(new(T))}
+}
+
+// Ancestor returns a derivative query with an ancestor filter.
+// The key of ancestor is generated from the struct.
+func (tq *TypedQuery[T]) Ancestor(ancestor interface{}) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Ancestor(ancestor)}
+}
+
+// AncestorKey returns a derivative query with an ancestor filter by key.
+func (tq *TypedQuery[T]) AncestorKey(key *datastore.Key) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.AncestorKey(key)}
+}
+
+// Filter returns a derivative query with a field-based filter.
+func (tq *TypedQuery[T]) Filter(filterStr string, value interface{}) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Filter(filterStr, value)}
+}
+
+// Order returns a derivative query with a field-based sort order.
+func (tq *TypedQuery[T]) Order(fieldName string) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Order(fieldName)}
+}
+
+// Project returns a derivative query that yields only the given fields.
+func (tq *TypedQuery[T]) Project(fieldNames ...string) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Project(fieldNames...)}
+}
+
+// Namespace returns a derivative query that is associated with the given namespace.
+func (tq *TypedQuery[T]) Namespace(ns string) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Namespace(ns)}
+}
+
+// Limit returns a derivative query that has a limit on the number of results returned.
+func (tq *TypedQuery[T]) Limit(limit int) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Limit(limit)}
+}
+
+// Offset returns a derivative query that has an offset of how many keys to skip over before returning results.
+func (tq *TypedQuery[T]) Offset(offset int) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Offset(offset)}
+}
+
+// Start returns a derivative query with the given start point.
+func (tq *TypedQuery[T]) Start(c datastore.Cursor) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.Start(c)}
+}
+
+// End returns a derivative query with the given end point.
+func (tq *TypedQuery[T]) End(c datastore.Cursor) *TypedQuery[T] {
+	return &TypedQuery[T]{q: tq.q.End(c)}
+}
+
+// Err returns the first error occurred while building the query.
+func (tq *TypedQuery[T]) Err() error {
+	return tq.q.Err()
+}
+
+// DatastoreQuery returns datastore.Query built by tq.
+func (tq *TypedQuery[T]) DatastoreQuery() (*datastore.Query, error) {
+	return tq.q.DatastoreQuery()
+}
+
+// Query returns Query of tq which runs on gm.
+func (tq *TypedQuery[T]) Query(gm *Gonm) *Query {
+	q := tq.q.clone()
+	q.gm = gm
+	return q
+}
+
+// GetAll runs the query on gm and returns all entities that match it with their keys.
+// All returned structures are complemented with their keys.
+func (tq *TypedQuery[T]) GetAll(gm *Gonm) ([]*T, []*datastore.Key, error) {
+	var dst []*T
+	keys, err := tq.Query(gm).GetAll(&dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dst, keys, nil
+}
+
+// GetKeysOnly runs the query on gm and returns the keys and the cursor.
+func (tq *TypedQuery[T]) GetKeysOnly(gm *Gonm) ([]*datastore.Key, datastore.Cursor, error) {
+	return tq.Query(gm).GetKeysOnly()
+}
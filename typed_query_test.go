@@ -0,0 +1,33 @@
+package gonm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewQuery(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	gm := newTestGonm(ctx)
+
+	putModel := []*testModel{
+		{ID: 1, Name: "Michael"},
+		{ID: 2, Name: "Tom"},
+	}
+	if _, err := gm.PutMulti(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+
+	users, keys, err := NewQuery[testModel]().Filter("Name =", "Tom").GetAll(gm)
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Len(keys, 1)
+	assert.Equal(putModel[1], users[0])
+
+	_, _, err = NewQuery[testModel]().Order("-Age").GetAll(gm)
+	assert.True(errors.Is(err, ErrUnknownProperty), "unknown property")
+}
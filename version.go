@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2019 The Gonm Author
+ *
+ * File for optimistic concurrency with version field
+ */
+
+package gonm
+
+import (
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// versionedStruct is a version field which is set to version when the transaction is committed.
+type versionedStruct struct {
+	field   reflect.Value
+	version int64
+}
+
+func (pl *pendingList) addVersions(vs []versionedStruct) {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+
+	pl.versions = append(pl.versions, vs...)
+}
+
+// versionFieldInfo is a field tagged with gonm:"version" found by findVersionFields.
+type versionFieldInfo struct {
+	field reflect.StructField
+	// index is the index sequence of the field for reflect.Value.FieldByIndex.
+	index []int
+	// property is the property name of the field, which is "" when the field is not saved.
+	property string
+}
+
+// findVersionFields returns the fields tagged with gonm:"version" of struct type t.
+// Embedded structs are walked in the same way as datastore.SaveStruct names their fields:
+// the fields of an anonymous struct field without name are promoted,
+// and the fields of a struct field with flatten option are prefixed with its name and ".".
+func findVersionFields(t reflect.Type, index []int, prefix string) []versionFieldInfo {
+	var ret []versionFieldInfo
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		tag := strings.Split(tf.Tag.Get("datastore"), ",")
+		name := tag[0]
+		fieldIndex := append(append([]int(nil), index...), i)
+		if strings.Split(tf.Tag.Get("gonm"), ",")[0] == "version" {
+			info := versionFieldInfo{field: tf, index: fieldIndex}
+			switch name {
+			case "-":
+			case "":
+				info.property = prefix + tf.Name
+			default:
+				info.property = prefix + name
+			}
+			ret = append(ret, info)
+			continue
+		}
+		if tf.Type.Kind() != reflect.Struct {
+			continue
+		}
+		// the other struct fields are not saved or saved as entity values, whose fields are not walked
+		switch {
+		case name == "-":
+		case tf.Anonymous && name == "":
+			ret = append(ret, findVersionFields(tf.Type, fieldIndex, prefix)...)
+		case hasTagOption(tag[1:], "flatten"):
+			if name == "" {
+				name = tf.Name
+			}
+			ret = append(ret, findVersionFields(tf.Type, fieldIndex, prefix+name+".")...)
+		}
+	}
+	return ret
+}
+
+func hasTagOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// versionField returns the field tagged with gonm:"version" of the struct v, including the fields of embedded structs.
+func versionField(v reflect.Value) (field reflect.Value, ok bool, err error) {
+	t := v.Type()
+	infos := findVersionFields(t, nil, "")
+	if len(infos) == 0 {
+		return field, false, nil
+	}
+	if len(infos) > 1 {
+		return field, false, &FieldError{Type: t, Field: infos[1].field.Name, Tag: "version", Err: ErrDuplicateKeyField}
+	}
+	if infos[0].field.Type.Kind() != reflect.Int64 {
+		return field, false, &FieldError{Type: t, Field: infos[0].field.Name, Tag: "version", Err: ErrUnsupportedVersionType}
+	}
+	return v.FieldByIndex(infos[0].index), true, nil
+}
+
+// versionProperty returns the property name of the version field of struct type t.
+// If the version field is not saved, versionProperty returns "".
+func versionProperty(t reflect.Type) string {
+	infos := findVersionFields(t, nil, "")
+	if len(infos) == 0 {
+		return ""
+	}
+	return infos[0].property
+}
+
+// structValue returns the struct which vi, an element of src, holds.
+func structValue(vi reflect.Value) reflect.Value {
+	for vi.Kind() == reflect.Interface || vi.Kind() == reflect.Ptr {
+		vi = vi.Elem()
+	}
+	return vi
+}
+
+// hasVersionField reports whether any structure of the slice v has version field.
+func hasVersionField(v reflect.Value) bool {
+	for i := 0; i < v.Len(); i++ {
+		vi := structValue(v.Index(i))
+		if vi.Kind() != reflect.Struct {
+			continue
+		}
+		if _, ok, err := versionField(vi); ok || err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersions compares the version fields of srcs with the stored entities of keys in the transaction of gm,
+// and returns the version fields with their incremented versions.
+// The stored version of an entity which does not exist is 0.
+func (gm *Gonm) checkVersions(keys []*datastore.Key, srcs []reflect.Value) ([]versionedStruct, error) {
+	var (
+		vs        []versionedStruct
+		getKeys   []*datastore.Key
+		getDst    []interface{}
+		getFields []int
+	)
+	for i, src := range srcs {
+		field, ok, err := versionField(src)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if !field.CanSet() {
+			return nil, invalidType(src.Interface(), "pointer to a struct with version field")
+		}
+		vs = append(vs, versionedStruct{field: field, version: field.Int() + 1})
+		if keys[i].Incomplete() {
+			if field.Int() != 0 {
+				return nil, &VersionConflictError{Key: keys[i], Expected: field.Int()}
+			}
+			continue
+		}
+		getKeys = append(getKeys, keys[i])
+		getDst = append(getDst, reflect.New(src.Type()).Interface())
+		getFields = append(getFields, len(vs)-1)
+	}
+	if len(getKeys) == 0 {
+		return vs, nil
+	}
+
+	err := gm.tx.GetMulti(getKeys, getDst)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	for i, key := range getKeys {
+		var stored int64
+		switch {
+		case merr == nil || merr[i] == nil:
+			field, _, _ := versionField(reflect.ValueOf(getDst[i]).Elem())
+			stored = field.Int()
+		case merr[i] != datastore.ErrNoSuchEntity:
+			return nil, merr[i]
+		}
+		if expected := vs[getFields[i]].version - 1; stored != expected {
+			return nil, &VersionConflictError{Key: key, Expected: expected, Actual: stored}
+		}
+	}
+	return vs, nil
+}
+
+// setVersions sets the incremented versions to the fields of vs and returns the function to restore them.
+// The versions are set only while the structures are put,
+// so that the structures are changed only when the transaction is committed.
+func setVersions(vs []versionedStruct) (restore func()) {
+	old := make([]int64, len(vs))
+	for i, v := range vs {
+		old[i] = v.field.Int()
+		v.field.SetInt(v.version)
+	}
+	return func() {
+		for i, v := range vs {
+			v.field.SetInt(old[i])
+		}
+	}
+}
+
+// structValues returns the structs which the elements of the slice v hold.
+func structValues(v reflect.Value) []reflect.Value {
+	ret := make([]reflect.Value, v.Len())
+	for i := range ret {
+		ret[i] = structValue(v.Index(i))
+	}
+	return ret
+}
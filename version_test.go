@@ -0,0 +1,175 @@
+package gonm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type testVersionModel struct {
+	ID      int64 `datastore:"-"`
+	Name    string
+	Version int64 `gonm:"version"`
+}
+
+type testVersionEmbedded struct {
+	Revision int64 `datastore:"rev" gonm:"version"`
+}
+
+func TestVersionField(t *testing.T) {
+	assert := assert.New(t)
+
+	field, ok, err := versionField(reflect.ValueOf(testVersionModel{Version: 2}))
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(2), field.Int())
+
+	_, ok, err = versionField(reflect.ValueOf(testModel{}))
+	assert.NoError(err)
+	assert.False(ok, "no version field")
+
+	type duplicate struct {
+		ID int64
+		V1 int64 `gonm:"version"`
+		V2 int64 `gonm:"version"`
+	}
+	_, _, err = versionField(reflect.ValueOf(duplicate{}))
+	assert.Equal(&FieldError{Type: reflect.TypeOf(duplicate{}), Field: "V2", Tag: "version", Err: ErrDuplicateKeyField}, err)
+
+	type unsupported struct {
+		ID      int64
+		Version string `gonm:"version"`
+	}
+	_, _, err = versionField(reflect.ValueOf(unsupported{}))
+	assert.Equal(&FieldError{Type: reflect.TypeOf(unsupported{}), Field: "Version", Tag: "version", Err: ErrUnsupportedVersionType}, err)
+
+	type embedded struct {
+		ID int64
+		testVersionEmbedded
+	}
+	field, ok, err = versionField(reflect.ValueOf(&embedded{testVersionEmbedded: testVersionEmbedded{Revision: 3}}).Elem())
+	assert.NoError(err)
+	assert.True(ok, "version field of embedded struct")
+	assert.Equal(int64(3), field.Int())
+	assert.True(field.CanSet())
+
+	type nested struct {
+		testVersionEmbedded
+		Meta testVersionEmbedded `datastore:"meta,flatten"`
+	}
+	tests := []struct {
+		name string
+		typ  reflect.Type
+		want string
+	}{
+		{"top level", reflect.TypeOf(testVersionModel{}), "Version"},
+		{"embedded", reflect.TypeOf(embedded{}), "rev"},
+		{"flatten", reflect.TypeOf(struct {
+			Meta testVersionEmbedded `datastore:"meta,flatten"`
+		}{}), "meta.rev"},
+		{"entity value", reflect.TypeOf(struct{ Entity testVersionEmbedded }{}), ""},
+		{"ignored", reflect.TypeOf(struct {
+			Ignored testVersionEmbedded `datastore:"-"`
+		}{}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(tt.want, versionProperty(tt.typ))
+		})
+	}
+	_, _, err = versionField(reflect.ValueOf(nested{}))
+	assert.Equal(&FieldError{Type: reflect.TypeOf(nested{}), Field: "Revision", Tag: "version", Err: ErrDuplicateKeyField}, err)
+
+	assert.True(hasVersionField(reflect.ValueOf([]interface{}{&testModel{}, &testVersionModel{}})))
+	assert.False(hasVersionField(reflect.ValueOf([]testModel{{}})))
+}
+
+func TestGonm_PutVersion(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	putModel := &testVersionModel{ID: 1, Name: "Michael"}
+	if err := gm.Delete(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	if _, err := gm.Put(putModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(int64(1), putModel.Version)
+
+	stale := *putModel
+	putModel.Name = "Tom"
+	if _, err := gm.PutMulti([]*testVersionModel{putModel}); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(int64(2), putModel.Version)
+
+	stale.Name = "Jack"
+	_, err := gm.Put(&stale)
+	assert.Equal(&VersionConflictError{Key: datastore.IDKey(Kind(testVersionModel{}), 1, nil), Expected: 1, Actual: 2}, err)
+
+	gmtx, err := gm.NewTransaction()
+	if err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	if _, err := gmtx.Mutate(NewUpdate(putModel)); err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal(int64(2), putModel.Version, "increment on commit")
+	if _, err := gmtx.Commit(); err != nil {
+		t.Fatal(gmtx.printStackErrs(err))
+	}
+	assert.Equal(int64(3), putModel.Version)
+
+	getModel := &testVersionModel{ID: 1}
+	if err := gm.GetConsistency(getModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(putModel, getModel)
+}
+
+func TestGonm_MutateVersion(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	gm := newTestGonm(ctx)
+
+	type embeddedVersionModel struct {
+		ID   int64 `datastore:"-"`
+		Name string
+		testVersionEmbedded
+	}
+	src := &embeddedVersionModel{ID: 1, Name: "Michael"}
+	if err := gm.Delete(src); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	if _, err := gm.Mutate(NewInsert(src)); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(int64(1), src.Revision, "insert increments version")
+
+	stale := *src
+	src.Name = "Tom"
+	if _, err := gm.Mutate(NewUpsert(src)); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(int64(2), src.Revision, "upsert increments version")
+
+	getModel := &embeddedVersionModel{ID: 1}
+	if err := gm.GetConsistency(getModel); err != nil {
+		t.Fatal(gm.printStackErrs(err))
+	}
+	assert.Equal(src, getModel, "version of embedded struct is saved")
+
+	key := datastore.IDKey(Kind(embeddedVersionModel{}), 1, nil)
+	_, err := gm.Mutate(NewUpsert(&stale))
+	assert.Equal(&VersionConflictError{Key: key, Expected: 1, Actual: 2}, err, "stale upsert")
+
+	_, err = gm.Mutate(NewInsert(&embeddedVersionModel{ID: 2, testVersionEmbedded: testVersionEmbedded{Revision: 1}}))
+	assert.Equal(&VersionConflictError{Key: datastore.IDKey(Kind(embeddedVersionModel{}), 2, nil), Expected: 1}, err, "insert of new entity expects version 0")
+}